@@ -5,4 +5,5 @@ go 1.16
 require (
 	github.com/aliyun/aliyun-log-go-sdk v0.1.37
 	github.com/grafana/grafana-plugin-sdk-go v0.102.0
+	github.com/oschwald/maxminddb-golang v1.6.0
 )
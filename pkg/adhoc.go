@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	// tagValuesLimit bounds the values offered for an ad-hoc filter key.
+	tagValuesLimit = 100
+	// defaultResourceRange is the time range of resource calls having none.
+	defaultResourceRange = time.Hour
+)
+
+// AdhocFilter is a Grafana ad-hoc filter, Operator is one of =, !=, <, >, =~ and !~.
+type AdhocFilter struct {
+	Key      string `json:"key"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+}
+
+// searchKeyRe matches the keys usable without quotes in the search syntax.
+var searchKeyRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// applyAdhocFilters adds filters to query: as search conditions to a search, or to the
+// WHERE clause of the SQL of an analytic query. types are the index types of the fields,
+// used to compare numeric fields with numbers. Filters that cannot be applied are returned as notices.
+func applyAdhocFilters(query string, filters []AdhocFilter, types map[string]string) (string, []data.Notice) {
+	var conds []string
+	var notices []data.Notice
+	search, sql, isSQL := splitPipe(query)
+	for _, f := range filters {
+		var cond string
+		var err error
+		if isSQL {
+			cond, err = sqlFilter(f, types)
+		} else {
+			cond, err = searchFilter(f)
+		}
+		if err != nil {
+			notices = append(notices, data.Notice{
+				Severity: data.NoticeSeverityWarning,
+				Text:     fmt.Sprintf("ad-hoc filter %s %s %s ignored: %s", f.Key, f.Operator, f.Value, err.Error()),
+			})
+			continue
+		}
+		conds = append(conds, cond)
+	}
+	if len(conds) == 0 {
+		return query, notices
+	}
+	if isSQL {
+		return search + "|" + insertWhere(sql, strings.Join(conds, " and ")), notices
+	}
+	search = strings.TrimSpace(search)
+	if search == "" || search == "*" {
+		return strings.Join(conds, " and "), notices
+	}
+	return "(" + search + ") and " + strings.Join(conds, " and "), notices
+}
+
+// searchFilter renders f in the SLS search syntax.
+func searchFilter(f AdhocFilter) (string, error) {
+	key := f.Key
+	if !searchKeyRe.MatchString(key) {
+		key = quoteSearchValue(key)
+	}
+	value := f.Value
+	if _, err := strconv.ParseFloat(value, 64); err != nil {
+		value = quoteSearchValue(value)
+	}
+	switch f.Operator {
+	case "=", "":
+		return key + ": " + value, nil
+	case "!=":
+		return "not " + key + ": " + value, nil
+	case "<", ">":
+		n, err := filterNumber(f)
+		if err != nil {
+			return "", err
+		}
+		return key + " " + f.Operator + " " + n, nil
+	case "=~", "!~":
+		return "", fmt.Errorf("regex filters need an SQL query")
+	}
+	return "", fmt.Errorf("unsupported operator %s", f.Operator)
+}
+
+// sqlFilter renders f as an SQL condition.
+func sqlFilter(f AdhocFilter, types map[string]string) (string, error) {
+	key := quoteSQLIdent(f.Key)
+	value := quoteSQLValue(f.Value)
+	if _, err := strconv.ParseFloat(f.Value, 64); err == nil && isNumericType(types[f.Key]) {
+		value = f.Value
+	}
+	switch f.Operator {
+	case "=", "":
+		return key + " = " + value, nil
+	case "!=":
+		return key + " <> " + value, nil
+	case "<", ">":
+		n, err := filterNumber(f)
+		if err != nil {
+			return "", err
+		}
+		return "try_cast(" + key + " as double) " + f.Operator + " " + n, nil
+	case "=~":
+		return "regexp_like(" + key + ", " + quoteSQLValue(f.Value) + ")", nil
+	case "!~":
+		return "not regexp_like(" + key + ", " + quoteSQLValue(f.Value) + ")", nil
+	}
+	return "", fmt.Errorf("unsupported operator %s", f.Operator)
+}
+
+// filterNumber returns the value of a comparison filter, which must be a number.
+func filterNumber(f AdhocFilter) (string, error) {
+	n, err := strconv.ParseFloat(strings.TrimSpace(f.Value), 64)
+	if err != nil {
+		return "", fmt.Errorf("%s needs a number", f.Operator)
+	}
+	return strconv.FormatFloat(n, 'f', -1, 64), nil
+}
+
+// splitPipe splits an analytic query at its first | outside quotes.
+func splitPipe(query string) (string, string, bool) {
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '|':
+			return query[:i], query[i+1:], true
+		}
+	}
+	return query, "", false
+}
+
+// insertWhere adds cond to the WHERE clause of the innermost select reading the logstore,
+// the outer select or the subquery it reads from, creating the clause before GROUP BY,
+// HAVING, ORDER BY or LIMIT when missing.
+func insertWhere(sql string, cond string) string {
+	open := -1
+	scanKeywords(sql, func(pos int, word string, next string) bool {
+		if word != "from" {
+			return true
+		}
+		k := pos + len(word)
+		for k < len(sql) && (sql[k] == ' ' || sql[k] == '\t' || sql[k] == '\n') {
+			k++
+		}
+		if k < len(sql) && sql[k] == '(' {
+			open = k
+		}
+		return false
+	})
+	if open >= 0 {
+		if end := closingParen(sql, open); end > open {
+			return sql[:open+1] + insertWhere(sql[open+1:end], cond) + sql[end:]
+		}
+	}
+
+	where, end := -1, len(sql)
+	scanKeywords(sql, func(pos int, word string, next string) bool {
+		switch word {
+		case "where":
+			if where < 0 {
+				where = pos
+			}
+			return true
+		case "group", "order":
+			if next != "by" {
+				return true
+			}
+		case "having", "limit":
+		default:
+			return true
+		}
+		end = pos
+		return false
+	})
+	rest := sql[end:]
+	if rest != "" {
+		rest = " " + rest
+	}
+	if where >= 0 {
+		start := where + len("where")
+		return sql[:start] + " (" + strings.TrimSpace(sql[start:end]) + ") and " + cond + rest
+	}
+	return strings.TrimRight(sql[:end], " \t\n") + " where " + cond + rest
+}
+
+// closingParen returns the position of the parenthesis closing sql[open], -1 when unbalanced.
+func closingParen(sql string, open int) int {
+	var quote byte
+	depth := 0
+	for i := open; i < len(sql); i++ {
+		c := sql[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// scanKeywords calls visit with the position and lower case text of every word of sql outside
+// quotes and parentheses, and the word following it, until visit returns false.
+func scanKeywords(sql string, visit func(pos int, word string, next string) bool) {
+	isWord := func(c byte) bool {
+		return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+	}
+	wordAt := func(i int) (string, int) {
+		j := i
+		for j < len(sql) && isWord(sql[j]) {
+			j++
+		}
+		return strings.ToLower(sql[i:j]), j
+	}
+	var quote byte
+	depth := 0
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case depth == 0 && isWord(c) && (i == 0 || !isWord(sql[i-1])):
+			word, j := wordAt(i)
+			k := j
+			for k < len(sql) && (sql[k] == ' ' || sql[k] == '\t' || sql[k] == '\n') {
+				k++
+			}
+			next, _ := wordAt(k)
+			if !visit(i, word, next) {
+				return
+			}
+			i = j - 1
+		}
+	}
+}
+
+// tagOption is an entry of the ad-hoc filter keys and values.
+type tagOption struct {
+	Text string `json:"text"`
+}
+
+// handleTagKeys lists the indexed fields of a logstore as ad-hoc filter keys.
+// Parameters: project and logstore, the datasource ones by default.
+func (ds *SlsDatasource) handleTagKeys(w http.ResponseWriter, r *http.Request) {
+	logSource, ok := resourceSettings(w, r)
+	if !ok {
+		return
+	}
+	project, logstore := resourceLogStore(logSource, r)
+	if !logSource.logStoreAllowed(project, logstore) {
+		writeResourceError(w, http.StatusForbidden, fmt.Errorf("logstore %s/%s is not allowed", project, logstore))
+		return
+	}
+	idx, err := ds.GetIndex(logSource, project, logstore)
+	if err != nil {
+		writeResourceError(w, http.StatusBadGateway, err)
+		return
+	}
+	options := []tagOption{}
+	for _, key := range idx.Keys {
+		if key.Type != IndexTypeJSON {
+			options = append(options, tagOption{Text: key.Name})
+		}
+		for _, sub := range key.JSONKeys {
+			options = append(options, tagOption{Text: sub.Name})
+		}
+	}
+	writeJSON(w, options)
+}
+
+// handleTagValues lists the most frequent values of a key over the time range as ad-hoc filter values.
+// Parameters: key, from and to in milliseconds (the last hour by default), project and logstore.
+func (ds *SlsDatasource) handleTagValues(w http.ResponseWriter, r *http.Request) {
+	logSource, ok := resourceSettings(w, r)
+	if !ok {
+		return
+	}
+	project, logstore := resourceLogStore(logSource, r)
+	if !logSource.logStoreAllowed(project, logstore) {
+		writeResourceError(w, http.StatusForbidden, fmt.Errorf("logstore %s/%s is not allowed", project, logstore))
+		return
+	}
+	params := r.URL.Query()
+	key := params.Get("key")
+	if key == "" {
+		writeResourceError(w, http.StatusBadRequest, fmt.Errorf("missing key"))
+		return
+	}
+	from, to := resourceTimeRange(r)
+	query := fmt.Sprintf(`* | select %s as v, count(*) as c group by v order by c desc limit %d`,
+		quoteSQLIdent(key), tagValuesLimit)
+	resp, err := NewClient(logSource).GetLogs(project, logstore, "", from, to, query, tagValuesLimit, 0, true)
+	if err != nil {
+		writeResourceError(w, http.StatusBadGateway, err)
+		return
+	}
+	options := []tagOption{}
+	for _, alog := range resp.Logs {
+		if v := alog["v"]; v != "" && v != "null" {
+			options = append(options, tagOption{Text: v})
+		}
+	}
+	writeJSON(w, options)
+}
+
+// resourceTimeRange returns the from and to parameters of a resource call, given in
+// milliseconds, as seconds. It defaults to defaultResourceRange ending now.
+func resourceTimeRange(r *http.Request) (int64, int64) {
+	params := r.URL.Query()
+	to := time.Now().Unix()
+	if v, err := strconv.ParseInt(params.Get("to"), 10, 64); err == nil && v > 0 {
+		to = v / 1000
+	}
+	from := to - int64(defaultResourceRange/time.Second)
+	if v, err := strconv.ParseInt(params.Get("from"), 10, 64); err == nil && v > 0 && v/1000 < to {
+		from = v / 1000
+	}
+	return from, to
+}
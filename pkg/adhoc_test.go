@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestInsertWhere(t *testing.T) {
+	const cond = "a = 1"
+	tests := []struct {
+		name string
+		sql  string
+		want string
+	}{
+		{"no clause", " select count(*)", " select count(*) where a = 1"},
+		{"before group by", " select host, count(*) as c group by host", " select host, count(*) as c where a = 1 group by host"},
+		{"before order by and limit", " select * order by t desc limit 10", " select * where a = 1 order by t desc limit 10"},
+		{"before limit", " select * limit 10", " select * where a = 1 limit 10"},
+		{"before having", " select host, count(*) as c group by host having c > 1", " select host, count(*) as c where a = 1 group by host having c > 1"},
+		{"existing where", " select * where x > 1 order by t limit 10", " select * where (x > 1) and a = 1 order by t limit 10"},
+		{"existing where at the end", " select * where x > 1 or y < 2", " select * where (x > 1 or y < 2) and a = 1"},
+		{"upper case keywords", " SELECT count(*) WHERE x = 1 GROUP BY h", " SELECT count(*) WHERE (x = 1) and a = 1 GROUP BY h"},
+		{"subquery where and limit", " select count(*) from (select host where level = 'error' limit 5) group by host",
+			" select count(*) from (select host where (level = 'error') and a = 1 limit 5) group by host"},
+		{"subquery with outer where", " select h from (select host as h group by host) where h <> '' limit 3",
+			" select h from (select host as h where a = 1 group by host) where h <> '' limit 3"},
+		{"nested subqueries", " select count(*) from (select h from (select host as h from log) group by h)",
+			" select count(*) from (select h from (select host as h from log where a = 1) group by h)"},
+		{"from log", " select count(*) from log group by host", " select count(*) from log where a = 1 group by host"},
+		{"keywords in string literals", " select count(*) where msg = 'group by limit' limit 5",
+			" select count(*) where (msg = 'group by limit') and a = 1 limit 5"},
+		{"keywords in quoted identifiers", ` select "order", count(*) as c group by "order"`,
+			` select "order", count(*) as c where a = 1 group by "order"`},
+		{"order without by", " select x as ordering, count(*) as c group by x", " select x as ordering, count(*) as c where a = 1 group by x"},
+	}
+	for _, tt := range tests {
+		if got := insertWhere(tt.sql, cond); got != tt.want {
+			t.Errorf("%s: insertWhere(%q)\n got %q\nwant %q", tt.name, tt.sql, got, tt.want)
+		}
+	}
+}
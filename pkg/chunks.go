@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	// chunkParallelism bounds the chunks of one query running at the same time.
+	chunkParallelism = 4
+	// autoChunkSize is the window used when chunk is set to auto.
+	autoChunkSize = 24 * time.Hour
+	// chunkAuto picks the chunk window automatically.
+	chunkAuto = "auto"
+	// maxSearchLines is the most logs SLS returns for one search request.
+	maxSearchLines = 100
+	// mondayShift moves week bounds from the Thursday of the epoch to a Monday.
+	mondayShift = 4 * 24 * 3600
+)
+
+var (
+	moduloBucketRe     = regexp.MustCompile(`(?i)__time__\s*-\s*__time__\s*%\s*(\d+)`)
+	timeSeriesBucketRe = regexp.MustCompile(`(?i)time_series\s*\([^,]+,\s*'(\d+)([smhd])'`)
+	dateTruncBucketRe  = regexp.MustCompile(`(?i)date_trunc\s*\(\s*'(\w+)'`)
+)
+
+// chunkWindow is one [from, to) part of a chunked query, in seconds.
+type chunkWindow struct {
+	from int64
+	to   int64
+}
+
+// chunkPlan splits a query into windows of size seconds whose bounds are shift seconds past
+// a multiple of size, so that every time bucket of the query falls in one window.
+type chunkPlan struct {
+	size  int64
+	shift int64
+}
+
+// newChunkPlan parses the chunk setting of a query, a duration such as 6h or 1d, or auto, and
+// returns nil when it is not set. The size is rounded up to a multiple of the time bucket of
+// the query, and the bounds follow the bucket: UTC multiples for __time__ - __time__ % n, local
+// days and weeks of location for time_series and date_trunc. Month and longer buckets have no
+// fixed size and cannot be chunked.
+func newChunkPlan(chunk string, query string, interval time.Duration, location *time.Location, at int64) (*chunkPlan, error) {
+	var size time.Duration
+	switch chunk {
+	case "":
+		return nil, nil
+	case chunkAuto:
+		size = autoChunkSize
+	default:
+		d, err := parseChunkDuration(chunk)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk: %s", err.Error())
+		}
+		if d < time.Minute {
+			return nil, fmt.Errorf("invalid chunk: %s is less than 1m", chunk)
+		}
+		size = d
+	}
+	bucket, local, err := queryBucket(query, interval)
+	if err != nil {
+		return nil, err
+	}
+	plan := &chunkPlan{size: int64(size / time.Second)}
+	if step := int64(bucket / time.Second); step > 0 {
+		if plan.size%step != 0 {
+			plan.size = (plan.size/step + 1) * step
+		}
+		if local {
+			_, offset := time.Unix(at, 0).In(location).Zone()
+			plan.shift = -int64(offset)
+			if bucket == 7*24*time.Hour {
+				plan.shift += mondayShift
+			}
+		}
+	}
+	return plan, nil
+}
+
+// queryBucket returns the time bucket of query, defaulting to interval, and whether it
+// follows the local time rather than UTC.
+func queryBucket(query string, interval time.Duration) (time.Duration, bool, error) {
+	if m := moduloBucketRe.FindStringSubmatch(query); m != nil {
+		seconds, _ := strconv.ParseInt(m[1], 10, 64)
+		return time.Duration(seconds) * time.Second, false, nil
+	}
+	if m := timeSeriesBucketRe.FindStringSubmatch(query); m != nil {
+		n, _ := strconv.ParseInt(m[1], 10, 64)
+		unit := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour, "d": 24 * time.Hour}[m[2]]
+		return time.Duration(n) * unit, true, nil
+	}
+	if m := dateTruncBucketRe.FindStringSubmatch(query); m != nil {
+		switch strings.ToLower(m[1]) {
+		case "second":
+			return time.Second, true, nil
+		case "minute":
+			return time.Minute, true, nil
+		case "hour":
+			return time.Hour, true, nil
+		case "day":
+			return 24 * time.Hour, true, nil
+		case "week":
+			return 7 * 24 * time.Hour, true, nil
+		default:
+			return 0, false, fmt.Errorf("chunk cannot split %s buckets, remove chunk or use a shorter bucket", m[1])
+		}
+	}
+	return interval, true, nil
+}
+
+// parseChunkDuration parses a Go duration, also accepting a number of days like 1d.
+func parseChunkDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseInt(strings.TrimSuffix(s, "d"), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// windows splits [from, to) into windows whose inner bounds follow the plan.
+func (plan *chunkPlan) windows(from int64, to int64) []chunkWindow {
+	step := plan.size
+	if step <= 0 || to-from <= step {
+		return []chunkWindow{{from: from, to: to}}
+	}
+	var windows []chunkWindow
+	for start := from; start < to; {
+		n := start - plan.shift
+		end := n - n%step + step
+		if n < 0 && n%step != 0 {
+			end -= step
+		}
+		end += plan.shift
+		if end > to {
+			end = to
+		}
+		windows = append(windows, chunkWindow{from: start, to: end})
+		start = end
+	}
+	return windows
+}
+
+// span renders a window for notices.
+func (w chunkWindow) span() string {
+	return time.Unix(w.from, 0).UTC().Format(time.RFC3339) + " - " + time.Unix(w.to, 0).UTC().Format(time.RFC3339)
+}
+
+// GetLogsChunked runs the query over the windows of plan and merges the results into one response.
+// Analytic queries run with limited parallelism and their rows are concatenated, the windows
+// not overlapping; raw logs are read newest window first and paged like a single query. Failed or incomplete chunks are reported as
+// notices, the query fails only when every chunk failed.
+func (ds *SlsDatasource) GetLogsChunked(client *sls.Client, logSource *LogSource, queryInfo *QueryInfo,
+	from int64, to int64, plan *chunkPlan) (*sls.GetLogsResponse, []data.Notice, error) {
+	windows := plan.windows(from, to)
+	if !strings.Contains(queryInfo.Query, "|") {
+		return pageChunkedLogs(client, logSource, queryInfo, windows)
+	}
+
+	responses := make([]*sls.GetLogsResponse, len(windows))
+	errs := make([]error, len(windows))
+	parallel(len(windows), func(i int) {
+		responses[i], errs[i] = client.GetLogs(logSource.Project, logSource.LogStore, "",
+			windows[i].from, windows[i].to, queryInfo.Query, queryInfo.LogsPerPage, 0, true)
+	})
+
+	merged := &sls.GetLogsResponse{Progress: "Complete", HasSQL: true}
+	status := &chunkStatus{total: len(windows)}
+	for i, resp := range responses {
+		if errs[i] != nil {
+			log.DefaultLogger.Error("GetLogsChunked", "query", queryInfo.Query, "chunk", windows[i].span(), "error", errs[i])
+			status.fail(windows[i], errs[i])
+			continue
+		}
+		if !resp.IsComplete() {
+			status.incomplete = append(status.incomplete, windows[i].span())
+			merged.Progress = resp.Progress
+		}
+		if merged.Contents == "" {
+			merged.Contents = resp.Contents
+		}
+		merged.Logs = append(merged.Logs, resp.Logs...)
+	}
+	if len(status.failed) == len(windows) {
+		return nil, nil, status.lastErr
+	}
+	merged.Count = int64(len(merged.Logs))
+	return merged, status.notices(), nil
+}
+
+// pageChunkedLogs reads the page of raw logs of a search over windows, newest first. The log
+// counts of the windows let whole windows before the page be skipped, then logs are read at most
+// maxSearchLines at a time with an offset inside each window.
+func pageChunkedLogs(client *sls.Client, logSource *LogSource, queryInfo *QueryInfo,
+	windows []chunkWindow) (*sls.GetLogsResponse, []data.Notice, error) {
+	counts := make([]*sls.GetHistogramsResponse, len(windows))
+	errs := make([]error, len(windows))
+	parallel(len(windows), func(i int) {
+		counts[i], errs[i] = client.GetHistograms(logSource.Project, logSource.LogStore, "",
+			windows[i].from, windows[i].to, queryInfo.Query)
+	})
+
+	merged := &sls.GetLogsResponse{Progress: "Complete"}
+	status := &chunkStatus{total: len(windows)}
+	// an unset page size reads as many logs as GetLogs does by default
+	need := queryInfo.LogsPerPage
+	if need <= 0 {
+		need = maxSearchLines
+	}
+	skip := int64(0)
+	if queryInfo.CurrentPage > 1 {
+		skip = (queryInfo.CurrentPage - 1) * need
+	}
+	for i := len(windows) - 1; i >= 0; i-- {
+		w := windows[i]
+		if errs[i] != nil {
+			log.DefaultLogger.Error("GetLogsChunked", "query", queryInfo.Query, "chunk", w.span(), "error", errs[i])
+			status.fail(w, errs[i])
+			continue
+		}
+		if !counts[i].IsComplete() {
+			status.incomplete = append(status.incomplete, w.span())
+			merged.Progress = counts[i].Progress
+		}
+		if need <= 0 {
+			continue
+		}
+		if counts[i].Count <= skip {
+			skip -= counts[i].Count
+			continue
+		}
+		for offset := skip; need > 0 && offset < counts[i].Count; {
+			lines := need
+			if lines > maxSearchLines {
+				lines = maxSearchLines
+			}
+			resp, err := client.GetLogs(logSource.Project, logSource.LogStore, "", w.from, w.to, queryInfo.Query, lines, offset, true)
+			if err != nil {
+				log.DefaultLogger.Error("GetLogsChunked", "query", queryInfo.Query, "chunk", w.span(), "error", err)
+				status.fail(w, err)
+				break
+			}
+			if merged.Contents == "" {
+				merged.Contents = resp.Contents
+			}
+			merged.Logs = append(merged.Logs, resp.Logs...)
+			if len(resp.Logs) == 0 {
+				break
+			}
+			offset += int64(len(resp.Logs))
+			need -= int64(len(resp.Logs))
+		}
+		skip = 0
+	}
+	if len(status.failed) == len(windows) {
+		return nil, nil, status.lastErr
+	}
+	merged.Count = int64(len(merged.Logs))
+	return merged, status.notices(), nil
+}
+
+// parallel calls f for 0 to n-1, chunkParallelism at a time, and waits for them.
+func parallel(n int, f func(i int)) {
+	sem := make(chan struct{}, chunkParallelism)
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// chunkStatus collects the failed and incomplete windows of a chunked query.
+type chunkStatus struct {
+	total      int
+	failed     []string
+	incomplete []string
+	lastErr    error
+}
+
+func (s *chunkStatus) fail(w chunkWindow, err error) {
+	s.failed = append(s.failed, w.span())
+	s.lastErr = err
+}
+
+// notices reports the failed and incomplete windows.
+func (s *chunkStatus) notices() []data.Notice {
+	var notices []data.Notice
+	if len(s.failed) > 0 {
+		notices = append(notices, data.Notice{
+			Severity: data.NoticeSeverityError,
+			Text:     fmt.Sprintf("%d of %d chunks failed and are missing: %s (%s)", len(s.failed), s.total, strings.Join(s.failed, ", "), s.lastErr.Error()),
+		})
+	}
+	if len(s.incomplete) > 0 {
+		notices = append(notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("%d of %d chunks returned incomplete results: %s", len(s.incomplete), s.total, strings.Join(s.incomplete, ", ")),
+		})
+	}
+	return notices
+}
+
+// isChunkable reports whether a query can be split into chunks: raw log searches and
+// time series, whose rows belong to one time bucket. Other aggregations span the whole range.
+func isChunkable(xcol string, query string) bool {
+	if !strings.Contains(query, "|") {
+		return true
+	}
+	switch xcol {
+	case "", "bar", "map", "pie", "table", "trace":
+		return false
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// valueRawVariable is replaced by Grafana with the raw value of the clicked field.
+const valueRawVariable = "${__value.raw}"
+
+// defaultDerivedFieldQuery opens the matched value as a trace.
+const defaultDerivedFieldQuery = `{"type":"trace_id","traceId":"${__value.raw}"}`
+
+// DerivedField extracts a value from every log line into its own field and links it
+// to an external URL or to a query of this or another datasource.
+type DerivedField struct {
+	Name           string `json:"name"`
+	MatcherRegex   string `json:"matcherRegex"`
+	SourceField    string `json:"field"`
+	URL            string `json:"url"`
+	DatasourceName string `json:"datasourceName"`
+	Query          string `json:"query"`
+
+	re *regexp.Regexp
+}
+
+// Compile validates the derived field and compiles its regex.
+func (f *DerivedField) Compile() error {
+	if f.Name == "" {
+		return fmt.Errorf("derived field name is required")
+	}
+	if f.MatcherRegex == "" && f.SourceField == "" {
+		return fmt.Errorf("derived field %s needs a regex or a source field", f.Name)
+	}
+	if f.MatcherRegex != "" {
+		re, err := regexp.Compile(f.MatcherRegex)
+		if err != nil {
+			return fmt.Errorf("derived field %s: %s", f.Name, err.Error())
+		}
+		f.re = re
+	}
+	if f.URL == "" {
+		if f.Query == "" {
+			f.Query = defaultDerivedFieldQuery
+		}
+		var query map[string]interface{}
+		if err := json.Unmarshal([]byte(f.Query), &query); err != nil {
+			return fmt.Errorf("derived field %s: invalid query: %s", f.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+// Extract returns the value of the derived field for one log. The source field
+// defaults to message; the first capture group of the regex wins over the whole match.
+func (f *DerivedField) Extract(alog map[string]string, message string) string {
+	source := message
+	if f.SourceField != "" {
+		source = alog[f.SourceField]
+	}
+	if f.re == nil {
+		return source
+	}
+	match := f.re.FindStringSubmatch(source)
+	if match == nil {
+		return ""
+	}
+	if len(match) > 1 {
+		return match[1]
+	}
+	return match[0]
+}
+
+// Link returns the data link of the derived field.
+func (f *DerivedField) Link(logSource *LogSource, from int64, to int64) data.DataLink {
+	if f.URL != "" {
+		return data.DataLink{Title: f.Name, URL: f.URL, TargetBlank: true}
+	}
+	datasource := f.DatasourceName
+	if datasource == "" {
+		datasource = logSource.Name
+	}
+	query := make(map[string]interface{})
+	_ = json.Unmarshal([]byte(f.Query), &query)
+	return data.DataLink{Title: f.Name, URL: exploreURL(datasource, query, from, to)}
+}
+
+// BuildDerivedFields returns one field per derived field, values holds the
+// message of each log in logs.
+func BuildDerivedFields(logs []map[string]string, values []string, logSource *LogSource, from int64, to int64) []*data.Field {
+	var fields []*data.Field
+	for i := range logSource.DerivedFields {
+		f := &logSource.DerivedFields[i]
+		extracted := make([]string, 0, len(logs))
+		for j, alog := range logs {
+			message := ""
+			if j < len(values) {
+				message = values[j]
+			}
+			extracted = append(extracted, f.Extract(alog, message))
+		}
+		field := data.NewField(f.Name, nil, extracted)
+		field.Config = &data.FieldConfig{
+			Links: []data.DataLink{f.Link(logSource, from, to)},
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// exploreURL returns an Explore link running query against datasource, query
+// may reference ${__value.raw} to use the clicked value.
+func exploreURL(datasource string, query map[string]interface{}, from int64, to int64) string {
+	query["refId"] = "A"
+	left, _ := json.Marshal(map[string]interface{}{
+		"datasource": datasource,
+		"queries":    []map[string]interface{}{query},
+		"range": map[string]string{
+			"from": strconv.FormatInt(from*1000, 10),
+			"to":   strconv.FormatInt(to*1000, 10),
+		},
+	})
+	return "/explore?left=" + strings.ReplaceAll(url.QueryEscape(string(left)),
+		url.QueryEscape(valueRawVariable), valueRawVariable)
+}
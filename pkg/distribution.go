@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+)
+
+const (
+	// defaultDistributionTopN and maxDistributionTopN bound the values of a field distribution.
+	defaultDistributionTopN = 10
+	maxDistributionTopN     = 100
+)
+
+// distributionPercentiles are the approximate percentiles of numeric fields.
+var distributionPercentiles = []float64{0.5, 0.75, 0.9, 0.95, 0.99}
+
+// FieldDistribution is the quick analysis of a field over the logs of a search.
+type FieldDistribution struct {
+	Field  string              `json:"field"`
+	Total  int64               `json:"total"`
+	Values []DistributionValue `json:"values"`
+	Stats  *NumericStats       `json:"stats,omitempty"`
+}
+
+// DistributionValue is a frequent value of a field and its share of the logs, in percent.
+type DistributionValue struct {
+	Value   string  `json:"value"`
+	Count   int64   `json:"count"`
+	Percent float64 `json:"percent"`
+}
+
+// NumericStats summarizes a numeric field, percentiles are keyed like p50 or p99.
+type NumericStats struct {
+	Min         *float64            `json:"min"`
+	Max         *float64            `json:"max"`
+	Avg         *float64            `json:"avg"`
+	Percentiles map[string]*float64 `json:"percentiles"`
+}
+
+// GetFieldDistribution returns the topN values of field over the logs matching the search of query
+// in [from, to), with min, max, avg and percentiles when the field is indexed as a number.
+func (ds *SlsDatasource) GetFieldDistribution(logSource *LogSource, project string, logstore string,
+	query string, field string, topN int, from int64, to int64) (*FieldDistribution, error) {
+	search, _, _ := splitPipe(query)
+	if search = strings.TrimSpace(search); search == "" {
+		search = "*"
+	}
+	client := NewClient(logSource)
+	key := quoteSQLIdent(field)
+	numeric := false
+	if idx, err := ds.GetIndex(logSource, project, logstore); err == nil {
+		numeric = isNumericType(idx.FieldTypes()[field])
+	}
+
+	stats := "count(*) as total"
+	if numeric {
+		value := "try_cast(" + key + " as double)"
+		bounds := make([]string, 0, len(distributionPercentiles))
+		for _, p := range distributionPercentiles {
+			bounds = append(bounds, strconv.FormatFloat(p, 'f', -1, 64))
+		}
+		stats += fmt.Sprintf(", min(%s) as min, max(%s) as max, avg(%s) as avg, approx_percentile(%s, array[%s]) as p",
+			value, value, value, value, strings.Join(bounds, ", "))
+	}
+	resp, err := getAnalyticLogs(client, project, logstore, from, to, search+" | select "+stats)
+	if err != nil {
+		return nil, err
+	}
+	dist := &FieldDistribution{Field: field, Values: []DistributionValue{}}
+	if len(resp.Logs) > 0 {
+		row := resp.Logs[0]
+		dist.Total, _ = strconv.ParseInt(row["total"], 10, 64)
+		if numeric {
+			dist.Stats = &NumericStats{
+				Min:         parseFloatQuiet(row["min"]),
+				Max:         parseFloatQuiet(row["max"]),
+				Avg:         parseFloatQuiet(row["avg"]),
+				Percentiles: parsePercentiles(row["p"]),
+			}
+		}
+	}
+
+	resp, err = getAnalyticLogs(client, project, logstore, from, to,
+		fmt.Sprintf("%s | select %s as v, count(*) as c group by v order by c desc limit %d", search, key, topN))
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range resp.Logs {
+		count, _ := strconv.ParseInt(row["c"], 10, 64)
+		v := DistributionValue{Value: row["v"], Count: count}
+		if dist.Total > 0 {
+			v.Percent = math.Round(float64(count)*10000/float64(dist.Total)) / 100
+		}
+		dist.Values = append(dist.Values, v)
+	}
+	return dist, nil
+}
+
+// getAnalyticLogs runs an SQL query, failing when its result is incomplete.
+func getAnalyticLogs(client *sls.Client, project string, logstore string, from int64, to int64, query string) (*sls.GetLogsResponse, error) {
+	resp, err := client.GetLogs(project, logstore, "", from, to, query, 0, 0, true)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.IsComplete() {
+		return nil, fmt.Errorf("incomplete result, try a shorter time range")
+	}
+	return resp, nil
+}
+
+// parsePercentiles reads the array returned by approx_percentile, e.g. [1.0, 2.5, null].
+func parsePercentiles(s string) map[string]*float64 {
+	var values []*float64
+	if err := json.Unmarshal([]byte(s), &values); err != nil {
+		return nil
+	}
+	percentiles := make(map[string]*float64, len(values))
+	for i, v := range values {
+		if i < len(distributionPercentiles) {
+			percentiles["p"+strconv.FormatFloat(distributionPercentiles[i]*100, 'f', -1, 64)] = v
+		}
+	}
+	return percentiles
+}
+
+// handleDistribution returns the quick analysis of a field.
+// Parameters: field, query (the logs searched, * by default), topN, from and to in milliseconds,
+// project and logstore.
+func (ds *SlsDatasource) handleDistribution(w http.ResponseWriter, r *http.Request) {
+	logSource, ok := resourceSettings(w, r)
+	if !ok {
+		return
+	}
+	project, logstore := resourceLogStore(logSource, r)
+	if !logSource.logStoreAllowed(project, logstore) {
+		writeResourceError(w, http.StatusForbidden, fmt.Errorf("logstore %s/%s is not allowed", project, logstore))
+		return
+	}
+	params := r.URL.Query()
+	field := params.Get("field")
+	if field == "" {
+		writeResourceError(w, http.StatusBadRequest, fmt.Errorf("missing field"))
+		return
+	}
+	topN, _ := strconv.Atoi(params.Get("topN"))
+	if topN <= 0 {
+		topN = defaultDistributionTopN
+	} else if topN > maxDistributionTopN {
+		topN = maxDistributionTopN
+	}
+	from, to := resourceTimeRange(r)
+	dist, err := ds.GetFieldDistribution(logSource, project, logstore, params.Get("query"), field, topN, from, to)
+	if err != nil {
+		writeResourceError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, dist)
+}
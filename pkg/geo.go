@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+	"github.com/oschwald/maxminddb-golang"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// geoColumnNames are the column names detected when the query does not name the geo columns.
+var geoColumnNames = map[string][]string{
+	"latitude":  {"latitude", "lat"},
+	"longitude": {"longitude", "lon", "lng", "long"},
+	"geohash":   {"geohash", "geo"},
+	"country":   {"country", "country_code", "countrycode"},
+	"province":  {"province", "province_code", "region"},
+	"ip":        {"ip", "client_ip", "remote_addr", "remote_ip", "src_ip"},
+}
+
+// provinceSuffixes are stripped from Chinese province names before lookup.
+var provinceSuffixes = []string{"壮族自治区", "回族自治区", "维吾尔自治区", "特别行政区", "自治区", "省", "市"}
+
+var (
+	countryIndex  = newGeoIndex(geoCountries, nil)
+	provinceIndex = newGeoIndex(geoProvinces, provinceSuffixes)
+)
+
+// newGeoIndex indexes places by lower case code, English and Chinese name. Codes of
+// the form CN-ZJ are also indexed without the country prefix.
+func newGeoIndex(places []geoPlace, suffixes []string) map[string]*geoPlace {
+	index := make(map[string]*geoPlace)
+	for i := range places {
+		p := &places[i]
+		index[strings.ToLower(p.code)] = p
+		if i := strings.Index(p.code, "-"); i >= 0 {
+			index[strings.ToLower(p.code[i+1:])] = p
+		}
+		index[strings.ToLower(p.en)] = p
+		index[p.zh] = p
+		for _, suffix := range suffixes {
+			if strings.HasSuffix(p.zh, suffix) {
+				index[strings.TrimSuffix(p.zh, suffix)] = p
+				break
+			}
+		}
+	}
+	return index
+}
+
+// ipRecord is the subset of a GeoLite2/GeoIP2 City record used for enrichment.
+type ipRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+}
+
+// GeoIPReader opens the GeoIP database of the datasource once and keeps it until Dispose.
+func (ds *SlsDatasource) GeoIPReader(path string) (*maxminddb.Reader, error) {
+	ds.geoIPMu.Lock()
+	defer ds.geoIPMu.Unlock()
+	if ds.geoIP != nil && ds.geoIPPath == path {
+		return ds.geoIP, nil
+	}
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening geoip database: %s", err.Error())
+	}
+	if ds.geoIP != nil {
+		ds.geoIP.Close()
+	}
+	ds.geoIP = reader
+	ds.geoIPPath = path
+	return reader, nil
+}
+
+// QueryGeo runs the query and builds a frame with latitude and longitude fields for the Geomap panel.
+func (ds *SlsDatasource) QueryGeo(client *sls.Client, logSource *LogSource, queryInfo *QueryInfo,
+	from int64, to int64, frames *data.Frames) error {
+	getLogsResp, err := client.GetLogs(logSource.Project, logSource.LogStore, "",
+		from, to, queryInfo.Query, queryInfo.LogsPerPage, 0, true)
+	if err != nil {
+		log.DefaultLogger.Error("QueryGeo", "query", queryInfo.Query, "error", err)
+		return err
+	}
+	var reader *maxminddb.Reader
+	if logSource.GeoIPDatabase != "" {
+		if reader, err = ds.GeoIPReader(logSource.GeoIPDatabase); err != nil {
+			return err
+		}
+	}
+	c := &Contents{}
+	if getLogsResp.Contents != "" {
+		_ = json.Unmarshal([]byte(getLogsResp.Contents), &c)
+	}
+	ds.BuildGeo(getLogsResp.Logs, c.Keys, queryInfo, reader, frames)
+	return nil
+}
+
+// geoColumns resolves the geo columns of a result, preferring the columns named in the query.
+func geoColumns(keys []string, queryInfo *QueryInfo) map[string]string {
+	cols := map[string]string{
+		"latitude":  queryInfo.Latitude,
+		"longitude": queryInfo.Longitude,
+		"geohash":   queryInfo.Geohash,
+		"country":   queryInfo.Country,
+		"province":  queryInfo.Province,
+		"ip":        queryInfo.IP,
+	}
+	for kind, names := range geoColumnNames {
+		if cols[kind] != "" {
+			continue
+		}
+		for _, key := range keys {
+			for _, name := range names {
+				if strings.EqualFold(key, name) {
+					cols[kind] = key
+				}
+			}
+		}
+	}
+	return cols
+}
+
+// BuildGeo
+// keeps the result columns and adds latitude and longitude taken, in order, from
+// the latitude/longitude columns, a geohash, the GeoIP database, a province or a country.
+// Country names are normalized to an ISO 3166-1 alpha-2 country_code field.
+func (ds *SlsDatasource) BuildGeo(logs []map[string]string, keys []string, queryInfo *QueryInfo,
+	reader *maxminddb.Reader, frames *data.Frames) {
+	if len(keys) == 0 && len(logs) > 0 {
+		for k := range logs[0] {
+			if k != "__time__" && k != "__source__" {
+				keys = append(keys, k)
+			}
+		}
+	}
+	cols := geoColumns(keys, queryInfo)
+	frame := data.NewFrame("geo")
+
+	var lats, lons []*float64
+	var ipCountry, ipProvince, ipCity []string
+	unknown, unlisted, unlistedSample := 0, 0, ""
+	for _, alog := range logs {
+		lat, lon := geoLocate(alog, cols)
+		if cols["ip"] != "" && reader != nil {
+			record := &ipRecord{}
+			if ip := net.ParseIP(strings.TrimSpace(alog[cols["ip"]])); ip != nil {
+				if err := reader.Lookup(ip, record); err != nil {
+					log.DefaultLogger.Error("BuildGeo", "Lookup", err, "ip", alog[cols["ip"]])
+				}
+			}
+			province := ""
+			if len(record.Subdivisions) > 0 {
+				province = record.Subdivisions[0].Names["en"]
+			}
+			ipCountry = append(ipCountry, record.Country.IsoCode)
+			ipProvince = append(ipProvince, province)
+			ipCity = append(ipCity, record.City.Names["en"])
+			if lat == nil && record.Location.Latitude != nil && record.Location.Longitude != nil {
+				lat, lon = record.Location.Latitude, record.Location.Longitude
+			}
+		}
+		if lat == nil {
+			lat, lon = geoLookupPlace(alog, cols)
+		}
+		if lat == nil {
+			unknown++
+			if place := geoPlaceValue(alog, cols); place != "" {
+				if unlisted == 0 {
+					unlistedSample = place
+				}
+				unlisted++
+			}
+		}
+		lats = append(lats, lat)
+		lons = append(lons, lon)
+	}
+
+	for _, key := range keys {
+		if key == cols["latitude"] || key == cols["longitude"] {
+			continue
+		}
+		values := make([]string, 0, len(logs))
+		for _, alog := range logs {
+			values = append(values, alog[key])
+		}
+		if numbers, ok := numericValues(values); ok {
+			frame.Fields = append(frame.Fields, data.NewField(key, nil, numbers))
+		} else {
+			frame.Fields = append(frame.Fields, data.NewField(key, nil, values))
+		}
+	}
+	if col := cols["country"]; col != "" && strings.ToUpper(col) != "COUNTRY_CODE" {
+		codes := make([]string, 0, len(logs))
+		for _, alog := range logs {
+			code := ""
+			if p := lookupPlace(countryIndex, alog[col]); p != nil {
+				code = p.code
+			}
+			codes = append(codes, code)
+		}
+		frame.Fields = append(frame.Fields, data.NewField("country_code", nil, codes))
+	}
+	if ipCountry != nil {
+		frame.Fields = append(frame.Fields,
+			data.NewField("ip_country", nil, ipCountry),
+			data.NewField("ip_province", nil, ipProvince),
+			data.NewField("ip_city", nil, ipCity),
+		)
+	}
+	frame.Fields = append(frame.Fields,
+		data.NewField("latitude", nil, append(make([]*float64, 0, len(lats)), lats...)),
+		data.NewField("longitude", nil, append(make([]*float64, 0, len(lons)), lons...)),
+	)
+	if unknown > 0 {
+		text := fmt.Sprintf("%d row(s) could not be located", unknown)
+		if unlisted > 0 {
+			text += fmt.Sprintf(", %d of them name a country or province missing from the built-in tables, e.g. %q: "+
+				"countries are limited to %d common ISO 3166-1 codes and provinces to China, use a GeoIP database "+
+				"or latitude/longitude columns instead", unlisted, unlistedSample, len(geoCountries))
+		}
+		frame.Meta = &data.FrameMeta{Notices: []data.Notice{{
+			Severity: data.NoticeSeverityInfo,
+			Text:     text,
+		}}}
+	}
+	*frames = append(*frames, frame)
+}
+
+// geoLocate returns the coordinates given by the latitude/longitude or geohash columns.
+func geoLocate(alog map[string]string, cols map[string]string) (*float64, *float64) {
+	if cols["latitude"] != "" && cols["longitude"] != "" {
+		lat := parseNullableFloat("BuildGeo", alog[cols["latitude"]])
+		lon := parseNullableFloat("BuildGeo", alog[cols["longitude"]])
+		if lat != nil && lon != nil {
+			return lat, lon
+		}
+	}
+	if cols["geohash"] != "" {
+		if lat, lon, ok := decodeGeohash(alog[cols["geohash"]]); ok {
+			return &lat, &lon
+		}
+	}
+	return nil, nil
+}
+
+// geoLookupPlace returns the centroid of the province or country columns.
+func geoLookupPlace(alog map[string]string, cols map[string]string) (*float64, *float64) {
+	if cols["province"] != "" {
+		if p := lookupPlace(provinceIndex, alog[cols["province"]]); p != nil {
+			return &p.lat, &p.lon
+		}
+	}
+	if cols["country"] != "" {
+		if p := lookupPlace(countryIndex, alog[cols["country"]]); p != nil {
+			return &p.lat, &p.lon
+		}
+	}
+	return nil, nil
+}
+
+// geoPlaceValue returns the province or country value of a row, empty when it has none.
+func geoPlaceValue(alog map[string]string, cols map[string]string) string {
+	for _, col := range []string{cols["province"], cols["country"]} {
+		if v := strings.TrimSpace(alog[col]); col != "" && v != "" && !strings.EqualFold(v, "null") {
+			return v
+		}
+	}
+	return ""
+}
+
+func lookupPlace(index map[string]*geoPlace, v string) *geoPlace {
+	v = strings.TrimSpace(v)
+	if p, ok := index[strings.ToLower(v)]; ok {
+		return p
+	}
+	return index[v]
+}
+
+// numericValues converts values to numbers when every non empty value is numeric.
+func numericValues(values []string) ([]*float64, bool) {
+	numbers := make([]*float64, 0, len(values))
+	found := false
+	for _, v := range values {
+		f := parseFloatQuiet(v)
+		if f == nil && strings.TrimSpace(v) != "" && !strings.EqualFold(v, "null") {
+			return nil, false
+		}
+		found = found || f != nil
+		numbers = append(numbers, f)
+	}
+	return numbers, found
+}
+
+// parseFloatQuiet is parseNullableFloat without logging, used to probe column types.
+func parseFloatQuiet(v string) *float64 {
+	f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || math.IsNaN(f) {
+		return nil
+	}
+	return &f
+}
+
+const geohashBase32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// decodeGeohash returns the center of the geohash cell.
+func decodeGeohash(hash string) (float64, float64, bool) {
+	hash = strings.ToLower(strings.TrimSpace(hash))
+	if hash == "" {
+		return 0, 0, false
+	}
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+	even := true
+	for _, c := range hash {
+		idx := strings.IndexRune(geohashBase32, c)
+		if idx < 0 {
+			return 0, 0, false
+		}
+		for bit := 4; bit >= 0; bit-- {
+			r := &latRange
+			if even {
+				r = &lonRange
+			}
+			mid := (r[0] + r[1]) / 2
+			if idx&(1<<uint(bit)) != 0 {
+				r[0] = mid
+			} else {
+				r[1] = mid
+			}
+			even = !even
+		}
+	}
+	return (latRange[0] + latRange[1]) / 2, (lonRange[0] + lonRange[1]) / 2, true
+}
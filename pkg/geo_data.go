@@ -0,0 +1,183 @@
+package main
+
+// geoPlace is a named area with the coordinates of its centroid.
+type geoPlace struct {
+	code string
+	en   string
+	zh   string
+	lat  float64
+	lon  float64
+}
+
+// geoCountries are countries by ISO 3166-1 alpha-2 code, with the English and
+// Chinese names returned by ip_to_country. The table covers the common countries
+// only, BuildGeo reports the others in its notice.
+var geoCountries = []geoPlace{
+	{"AE", "United Arab Emirates", "阿联酋", 23.424076, 53.847818},
+	{"AF", "Afghanistan", "阿富汗", 33.93911, 67.709953},
+	{"AL", "Albania", "阿尔巴尼亚", 41.153332, 20.168331},
+	{"AM", "Armenia", "亚美尼亚", 40.069099, 45.038189},
+	{"AO", "Angola", "安哥拉", -11.202692, 17.873887},
+	{"AR", "Argentina", "阿根廷", -38.416097, -63.616672},
+	{"AT", "Austria", "奥地利", 47.516231, 14.550072},
+	{"AU", "Australia", "澳大利亚", -25.274398, 133.775136},
+	{"AZ", "Azerbaijan", "阿塞拜疆", 40.143105, 47.576927},
+	{"BA", "Bosnia and Herzegovina", "波黑", 43.915886, 17.679076},
+	{"BD", "Bangladesh", "孟加拉国", 23.684994, 90.356331},
+	{"BE", "Belgium", "比利时", 50.503887, 4.469936},
+	{"BG", "Bulgaria", "保加利亚", 42.733883, 25.48583},
+	{"BH", "Bahrain", "巴林", 25.930414, 50.637772},
+	{"BN", "Brunei", "文莱", 4.535277, 114.727669},
+	{"BO", "Bolivia", "玻利维亚", -16.290154, -63.588653},
+	{"BR", "Brazil", "巴西", -14.235004, -51.92528},
+	{"BY", "Belarus", "白俄罗斯", 53.709807, 27.953389},
+	{"CA", "Canada", "加拿大", 56.130366, -106.346771},
+	{"CH", "Switzerland", "瑞士", 46.818188, 8.227512},
+	{"CL", "Chile", "智利", -35.675147, -71.542969},
+	{"CM", "Cameroon", "喀麦隆", 7.369722, 12.354722},
+	{"CN", "China", "中国", 35.86166, 104.195397},
+	{"CO", "Colombia", "哥伦比亚", 4.570868, -74.297333},
+	{"CR", "Costa Rica", "哥斯达黎加", 9.748917, -83.753428},
+	{"CU", "Cuba", "古巴", 21.521757, -77.781167},
+	{"CY", "Cyprus", "塞浦路斯", 35.126413, 33.429859},
+	{"CZ", "Czechia", "捷克", 49.817492, 15.472962},
+	{"DE", "Germany", "德国", 51.165691, 10.451526},
+	{"DK", "Denmark", "丹麦", 56.26392, 9.501785},
+	{"DO", "Dominican Republic", "多米尼加", 18.735693, -70.162651},
+	{"DZ", "Algeria", "阿尔及利亚", 28.033886, 1.659626},
+	{"EC", "Ecuador", "厄瓜多尔", -1.831239, -78.183406},
+	{"EE", "Estonia", "爱沙尼亚", 58.595272, 25.013607},
+	{"EG", "Egypt", "埃及", 26.820553, 30.802498},
+	{"ES", "Spain", "西班牙", 40.463667, -3.74922},
+	{"ET", "Ethiopia", "埃塞俄比亚", 9.145, 40.489673},
+	{"FI", "Finland", "芬兰", 61.92411, 25.748151},
+	{"FR", "France", "法国", 46.227638, 2.213749},
+	{"GB", "United Kingdom", "英国", 55.378051, -3.435973},
+	{"GE", "Georgia", "格鲁吉亚", 42.315407, 43.356892},
+	{"GH", "Ghana", "加纳", 7.946527, -1.023194},
+	{"GR", "Greece", "希腊", 39.074208, 21.824312},
+	{"GT", "Guatemala", "危地马拉", 15.783471, -90.230759},
+	{"HK", "Hong Kong", "香港", 22.396428, 114.109497},
+	{"HN", "Honduras", "洪都拉斯", 15.199999, -86.241905},
+	{"HR", "Croatia", "克罗地亚", 45.1, 15.2},
+	{"HU", "Hungary", "匈牙利", 47.162494, 19.503304},
+	{"ID", "Indonesia", "印度尼西亚", -0.789275, 113.921327},
+	{"IE", "Ireland", "爱尔兰", 53.41291, -8.24389},
+	{"IL", "Israel", "以色列", 31.046051, 34.851612},
+	{"IN", "India", "印度", 20.593684, 78.96288},
+	{"IQ", "Iraq", "伊拉克", 33.223191, 43.679291},
+	{"IR", "Iran", "伊朗", 32.427908, 53.688046},
+	{"IS", "Iceland", "冰岛", 64.963051, -19.020835},
+	{"IT", "Italy", "意大利", 41.87194, 12.56738},
+	{"JM", "Jamaica", "牙买加", 18.109581, -77.297508},
+	{"JO", "Jordan", "约旦", 30.585164, 36.238414},
+	{"JP", "Japan", "日本", 36.204824, 138.252924},
+	{"KE", "Kenya", "肯尼亚", -0.023559, 37.906193},
+	{"KG", "Kyrgyzstan", "吉尔吉斯斯坦", 41.20438, 74.766098},
+	{"KH", "Cambodia", "柬埔寨", 12.565679, 104.990963},
+	{"KP", "North Korea", "朝鲜", 40.339852, 127.510093},
+	{"KR", "South Korea", "韩国", 35.907757, 127.766922},
+	{"KW", "Kuwait", "科威特", 29.31166, 47.481766},
+	{"KZ", "Kazakhstan", "哈萨克斯坦", 48.019573, 66.923684},
+	{"LA", "Laos", "老挝", 19.85627, 102.495496},
+	{"LB", "Lebanon", "黎巴嫩", 33.854721, 35.862285},
+	{"LK", "Sri Lanka", "斯里兰卡", 7.873054, 80.771797},
+	{"LT", "Lithuania", "立陶宛", 55.169438, 23.881275},
+	{"LU", "Luxembourg", "卢森堡", 49.815273, 6.129583},
+	{"LV", "Latvia", "拉脱维亚", 56.879635, 24.603189},
+	{"LY", "Libya", "利比亚", 26.3351, 17.228331},
+	{"MA", "Morocco", "摩洛哥", 31.791702, -7.09262},
+	{"MD", "Moldova", "摩尔多瓦", 47.411631, 28.369885},
+	{"MG", "Madagascar", "马达加斯加", -18.766947, 46.869107},
+	{"MK", "North Macedonia", "北马其顿", 41.608635, 21.745275},
+	{"MM", "Myanmar", "缅甸", 21.913965, 95.956223},
+	{"MN", "Mongolia", "蒙古", 46.862496, 103.846656},
+	{"MO", "Macao", "澳门", 22.198745, 113.543873},
+	{"MT", "Malta", "马耳他", 35.937496, 14.375416},
+	{"MU", "Mauritius", "毛里求斯", -20.348404, 57.552152},
+	{"MV", "Maldives", "马尔代夫", 3.202778, 73.22068},
+	{"MX", "Mexico", "墨西哥", 23.634501, -102.552784},
+	{"MY", "Malaysia", "马来西亚", 4.210484, 101.975766},
+	{"MZ", "Mozambique", "莫桑比克", -18.665695, 35.529562},
+	{"NG", "Nigeria", "尼日利亚", 9.081999, 8.675277},
+	{"NL", "Netherlands", "荷兰", 52.132633, 5.291266},
+	{"NO", "Norway", "挪威", 60.472024, 8.468946},
+	{"NP", "Nepal", "尼泊尔", 28.394857, 84.124008},
+	{"NZ", "New Zealand", "新西兰", -40.900557, 174.885971},
+	{"OM", "Oman", "阿曼", 21.512583, 55.923255},
+	{"PA", "Panama", "巴拿马", 8.537981, -80.782127},
+	{"PE", "Peru", "秘鲁", -9.189967, -75.015152},
+	{"PH", "Philippines", "菲律宾", 12.879721, 121.774017},
+	{"PK", "Pakistan", "巴基斯坦", 30.375321, 69.345116},
+	{"PL", "Poland", "波兰", 51.919438, 19.145136},
+	{"PR", "Puerto Rico", "波多黎各", 18.220833, -66.590149},
+	{"PT", "Portugal", "葡萄牙", 39.399872, -8.224454},
+	{"PY", "Paraguay", "巴拉圭", -23.442503, -58.443832},
+	{"QA", "Qatar", "卡塔尔", 25.354826, 51.183884},
+	{"RO", "Romania", "罗马尼亚", 45.943161, 24.96676},
+	{"RS", "Serbia", "塞尔维亚", 44.016521, 21.005859},
+	{"RU", "Russia", "俄罗斯", 61.52401, 105.318756},
+	{"SA", "Saudi Arabia", "沙特阿拉伯", 23.885942, 45.079162},
+	{"SE", "Sweden", "瑞典", 60.128161, 18.643501},
+	{"SG", "Singapore", "新加坡", 1.352083, 103.819836},
+	{"SI", "Slovenia", "斯洛文尼亚", 46.151241, 14.995463},
+	{"SK", "Slovakia", "斯洛伐克", 48.669026, 19.699024},
+	{"SY", "Syria", "叙利亚", 34.802075, 38.996815},
+	{"TH", "Thailand", "泰国", 15.870032, 100.992541},
+	{"TJ", "Tajikistan", "塔吉克斯坦", 38.861034, 71.276093},
+	{"TM", "Turkmenistan", "土库曼斯坦", 38.969719, 59.556278},
+	{"TN", "Tunisia", "突尼斯", 33.886917, 9.537499},
+	{"TR", "Turkey", "土耳其", 38.963745, 35.243322},
+	{"TW", "Taiwan", "台湾", 23.69781, 120.960515},
+	{"TZ", "Tanzania", "坦桑尼亚", -6.369028, 34.888822},
+	{"UA", "Ukraine", "乌克兰", 48.379433, 31.16558},
+	{"UG", "Uganda", "乌干达", 1.373333, 32.290275},
+	{"US", "United States", "美国", 37.09024, -95.712891},
+	{"UY", "Uruguay", "乌拉圭", -32.522779, -55.765835},
+	{"UZ", "Uzbekistan", "乌兹别克斯坦", 41.377491, 64.585262},
+	{"VE", "Venezuela", "委内瑞拉", 6.42375, -66.58973},
+	{"VN", "Vietnam", "越南", 14.058324, 108.277199},
+	{"YE", "Yemen", "也门", 15.552727, 48.516388},
+	{"ZA", "South Africa", "南非", -30.559482, 22.937506},
+	{"ZM", "Zambia", "赞比亚", -13.133897, 27.849332},
+	{"ZW", "Zimbabwe", "津巴布韦", -19.015438, 29.154857},
+}
+
+// geoProvinces are the provinces of China by ISO 3166-2:CN code, with the
+// names returned by ip_to_province.
+var geoProvinces = []geoPlace{
+	{"CN-AH", "Anhui", "安徽省", 31.8612, 117.2865},
+	{"CN-BJ", "Beijing", "北京市", 39.9042, 116.4074},
+	{"CN-CQ", "Chongqing", "重庆市", 29.5630, 106.5516},
+	{"CN-FJ", "Fujian", "福建省", 26.0745, 119.2965},
+	{"CN-GD", "Guangdong", "广东省", 23.1317, 113.2663},
+	{"CN-GS", "Gansu", "甘肃省", 36.0611, 103.8343},
+	{"CN-GX", "Guangxi", "广西壮族自治区", 22.8170, 108.3665},
+	{"CN-GZ", "Guizhou", "贵州省", 26.5982, 106.7074},
+	{"CN-HA", "Henan", "河南省", 34.7466, 113.6254},
+	{"CN-HB", "Hubei", "湖北省", 30.5928, 114.3055},
+	{"CN-HE", "Hebei", "河北省", 38.0428, 114.5149},
+	{"CN-HI", "Hainan", "海南省", 20.0174, 110.3492},
+	{"CN-HK", "Hong Kong", "香港特别行政区", 22.3193, 114.1694},
+	{"CN-HL", "Heilongjiang", "黑龙江省", 45.7420, 126.6617},
+	{"CN-HN", "Hunan", "湖南省", 28.2282, 112.9388},
+	{"CN-JL", "Jilin", "吉林省", 43.8171, 125.3235},
+	{"CN-JS", "Jiangsu", "江苏省", 32.0603, 118.7969},
+	{"CN-JX", "Jiangxi", "江西省", 28.6829, 115.8582},
+	{"CN-LN", "Liaoning", "辽宁省", 41.8057, 123.4315},
+	{"CN-MO", "Macao", "澳门特别行政区", 22.1987, 113.5439},
+	{"CN-NM", "Inner Mongolia", "内蒙古自治区", 40.8424, 111.7491},
+	{"CN-NX", "Ningxia", "宁夏回族自治区", 38.4872, 106.2309},
+	{"CN-QH", "Qinghai", "青海省", 36.6171, 101.7782},
+	{"CN-SC", "Sichuan", "四川省", 30.5728, 104.0668},
+	{"CN-SD", "Shandong", "山东省", 36.6512, 117.1201},
+	{"CN-SH", "Shanghai", "上海市", 31.2304, 121.4737},
+	{"CN-SN", "Shaanxi", "陕西省", 34.3416, 108.9398},
+	{"CN-SX", "Shanxi", "山西省", 37.8706, 112.5489},
+	{"CN-TJ", "Tianjin", "天津市", 39.3434, 117.3616},
+	{"CN-TW", "Taiwan", "台湾省", 25.0330, 121.5654},
+	{"CN-XJ", "Xinjiang", "新疆维吾尔自治区", 43.8256, 87.6168},
+	{"CN-XZ", "Tibet", "西藏自治区", 29.6520, 91.1721},
+	{"CN-YN", "Yunnan", "云南省", 25.0389, 102.7183},
+	{"CN-ZJ", "Zhejiang", "浙江省", 30.2741, 120.1551},
+}
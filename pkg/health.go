@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const (
+	// healthDialTimeout bounds the connection to the endpoint.
+	healthDialTimeout = 5 * time.Second
+	// healthReadWindow is the time range read by the analytics and read checks.
+	healthReadWindow = time.Minute
+	// healthAnalyticQuery is the SQL query run by the analytics check.
+	healthAnalyticQuery = "* | select count(1)"
+
+	// HealthStageOK, HealthStageWarning, HealthStageError and HealthStageSkipped are the
+	// statuses of a health check stage. Stages following an error are skipped.
+	HealthStageOK      = "ok"
+	HealthStageWarning = "warning"
+	HealthStageError   = "error"
+	HealthStageSkipped = "skipped"
+)
+
+// credentialErrors are the SLS error codes of rejected credentials.
+var credentialErrors = map[string]bool{
+	sls.MISS_ACCESS_KEY_ID:      true,
+	sls.SIGNATURE_NOT_MATCH:     true,
+	"InvalidAccessKeyId":        true,
+	sls.REQUEST_TIME_TOO_SKEWED: true,
+}
+
+// HealthStage is the result of one step of the health check, LatencyMs is the time of its requests.
+type HealthStage struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	Message   string `json:"message,omitempty"`
+	LatencyMs int64  `json:"latencyMs"`
+}
+
+// HealthDetails are the JSONDetails of a health check. Message summarizes the stages,
+// Grafana shows it under the result of the datasource test.
+type HealthDetails struct {
+	Message string        `json:"message"`
+	Stages  []HealthStage `json:"stages"`
+}
+
+// healthCheck runs the stages of a health check in order.
+type healthCheck struct {
+	details HealthDetails
+	failed  bool
+}
+
+// run runs stage, or records it as skipped after a failed stage. stage returns the status and
+// message of the stage, an empty status meaning ok.
+func (h *healthCheck) run(name string, stage func() (string, string)) {
+	if h.failed {
+		h.details.Stages = append(h.details.Stages, HealthStage{Name: name, Status: HealthStageSkipped})
+		return
+	}
+	start := time.Now()
+	status, message := stage()
+	if status == "" {
+		status = HealthStageOK
+	}
+	h.failed = status == HealthStageError
+	h.details.Stages = append(h.details.Stages, HealthStage{
+		Name:      name,
+		Status:    status,
+		Message:   message,
+		LatencyMs: time.Since(start).Milliseconds(),
+	})
+}
+
+// result returns the health check result, its message names the failed stage or the warnings.
+func (h *healthCheck) result() *backend.CheckHealthResult {
+	res := &backend.CheckHealthResult{Status: backend.HealthStatusOk, Message: "Data source is working"}
+	var warnings, summary []string
+	for _, s := range h.details.Stages {
+		if s.Status == HealthStageSkipped {
+			summary = append(summary, s.Name+": skipped")
+		} else {
+			summary = append(summary, fmt.Sprintf("%s: %s (%d ms)", s.Name, s.Status, s.LatencyMs))
+		}
+		switch s.Status {
+		case HealthStageError:
+			res.Status = backend.HealthStatusError
+			res.Message = fmt.Sprintf("%s check failed: %s", s.Name, s.Message)
+		case HealthStageWarning:
+			warnings = append(warnings, s.Name+": "+s.Message)
+		}
+	}
+	if res.Status == backend.HealthStatusOk && len(warnings) > 0 {
+		res.Message += ", with warnings: " + strings.Join(warnings, "; ")
+	}
+	h.details.Message = strings.Join(summary, ", ")
+	res.JSONDetails, _ = json.Marshal(&h.details)
+	return res
+}
+
+// checkHealth checks in stages that the endpoint is reachable, the credentials are valid, the
+// project and the logstore exist, the logstore is indexed and runs SQL, and its logs can be read.
+func (ds *SlsDatasource) checkHealth(ctx context.Context, logSource *LogSource) *backend.CheckHealthResult {
+	h := &healthCheck{}
+	client := NewClient(logSource)
+
+	h.run("endpoint", func() (string, string) {
+		if logSource.Endpoint == "" {
+			return HealthStageError, "no endpoint configured"
+		}
+		dialer := &net.Dialer{Timeout: healthDialTimeout}
+		conn, err := dialer.DialContext(ctx, "tcp", endpointAddress(logSource.Endpoint))
+		if err != nil {
+			return HealthStageError, err.Error()
+		}
+		conn.Close()
+		return "", ""
+	})
+
+	// the project request checks both the credentials and the project
+	var projectErr error
+	h.run("credentials", func() (string, string) {
+		if logSource.AccessKeyId == "" || logSource.AccessKeySecret == "" {
+			return HealthStageError, "no access key configured"
+		}
+		if logSource.Project == "" {
+			_, _, _, projectErr = client.ListProjectV2(0, 1)
+		} else {
+			_, projectErr = client.GetProject(logSource.Project)
+		}
+		if e, ok := projectErr.(*sls.Error); ok {
+			if credentialErrors[e.Code] || e.Code == sls.UN_AUTHORIZED && !permissionDenied(e) {
+				return HealthStageError, slsErrorMessage(projectErr)
+			}
+		} else if projectErr != nil {
+			return HealthStageError, projectErr.Error()
+		}
+		return "", ""
+	})
+	h.run("project", func() (string, string) {
+		if logSource.Project == "" {
+			return HealthStageError, "no project configured"
+		}
+		return notFoundStage(projectErr, sls.PROJECT_NOT_EXIST,
+			fmt.Sprintf("project %s does not exist in %s", logSource.Project, logSource.Endpoint))
+	})
+
+	h.run("logstore", func() (string, string) {
+		if logSource.LogStore == "" {
+			return HealthStageError, "no logstore configured"
+		}
+		_, err := client.GetLogStore(logSource.Project, logSource.LogStore)
+		return notFoundStage(err, sls.LOGSTORE_NOT_EXIST,
+			fmt.Sprintf("logstore %s does not exist in project %s", logSource.LogStore, logSource.Project))
+	})
+
+	var idx *LogStoreIndex
+	h.run("index", func() (string, string) {
+		index, err := client.GetIndex(logSource.Project, logSource.LogStore)
+		if e, ok := err.(*sls.Error); ok && e.Code == indexNotExist {
+			return HealthStageError, "the logstore has no index, enable it in the SLS console"
+		}
+		if e, ok := err.(*sls.Error); ok && permissionDenied(e) {
+			return HealthStageWarning, "cannot read the index configuration: " + slsErrorMessage(err)
+		}
+		if err != nil {
+			return HealthStageError, slsErrorMessage(err)
+		}
+		idx = newLogStoreIndex(index)
+		return "", ""
+	})
+
+	h.run("analytics", func() (string, string) {
+		to := time.Now().Unix()
+		_, err := client.GetLogs(logSource.Project, logSource.LogStore, "",
+			to-int64(healthReadWindow/time.Second), to, healthAnalyticQuery, 1, 0, true)
+		if err != nil {
+			return HealthStageError, "SQL query failed: " + slsErrorMessage(err)
+		}
+		if idx == nil {
+			return "", ""
+		}
+		for _, analytic := range idx.analyticFields() {
+			if analytic {
+				return "", ""
+			}
+		}
+		return HealthStageWarning, "no field is enabled for analytics, SQL queries on fields will fail"
+	})
+
+	h.run("read", func() (string, string) {
+		to := time.Now().Unix()
+		_, err := client.GetLogs(logSource.Project, logSource.LogStore, "",
+			to-int64(healthReadWindow/time.Second), to, "*", 1, 0, true)
+		if err != nil {
+			return HealthStageError, slsErrorMessage(err)
+		}
+		return "", ""
+	})
+
+	return h.result()
+}
+
+// notFoundStage returns the status of a stage checking the existence of a resource with err,
+// the error of reading it: an error when notFoundCode, a warning when permission is denied.
+func notFoundStage(err error, notFoundCode string, notFound string) (string, string) {
+	if err == nil {
+		return "", ""
+	}
+	if e, ok := err.(*sls.Error); ok {
+		if e.Code == notFoundCode {
+			return HealthStageError, notFound
+		}
+		if permissionDenied(e) {
+			return HealthStageWarning, "cannot be checked: " + slsErrorMessage(err)
+		}
+	}
+	return HealthStageError, slsErrorMessage(err)
+}
+
+// permissionDenied reports whether e is a RAM or STS denial, Unauthorized also being the
+// code of unknown access keys.
+func permissionDenied(e *sls.Error) bool {
+	return e.Code == sls.UN_AUTHORIZED && strings.Contains(strings.ToLower(e.Message), "denied")
+}
+
+// slsErrorMessage formats err with its SLS code and request id.
+func slsErrorMessage(err error) string {
+	if e, ok := err.(*sls.Error); ok {
+		message := e.Code + ": " + e.Message
+		if e.RequestID != "" {
+			message += " (request id " + e.RequestID + ")"
+		}
+		return message
+	}
+	return err.Error()
+}
+
+// endpointAddress returns the host:port of endpoint, the SLS client using http unless
+// the endpoint starts with https://.
+func endpointAddress(endpoint string) string {
+	port := "80"
+	if strings.HasPrefix(endpoint, "https://") {
+		port = "443"
+	}
+	host := strings.TrimPrefix(strings.TrimPrefix(endpoint, "https://"), "http://")
+	if i := strings.IndexByte(host, '/'); i >= 0 {
+		host = host[:i]
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// histogramMaxBuckets bounds the number of automatic histogram buckets.
+const histogramMaxBuckets = 100
+
+// QueryHeatmap runs a query returning time, bucket and count columns and builds heatmap cells.
+func (ds *SlsDatasource) QueryHeatmap(client *sls.Client, logSource *LogSource, queryInfo *QueryInfo,
+	from int64, to int64, frames *data.Frames) error {
+	parser, err := NewTimeParser(logSource.Timezone, queryInfo.TimeFormat)
+	if err != nil {
+		return err
+	}
+	getLogsResp, err := client.GetLogs(logSource.Project, logSource.LogStore, "",
+		from, to, queryInfo.Query, queryInfo.LogsPerPage, 0, true)
+	if err != nil {
+		log.DefaultLogger.Error("QueryHeatmap", "query", queryInfo.Query, "error", err)
+		return err
+	}
+	ycols := splitColumns(queryInfo.Ycol)
+	if len(ycols) != 2 {
+		return fmt.Errorf("heatmap needs ycol set to the bucket and count columns, e.g. bucket,count")
+	}
+	if queryInfo.Xcol == "" {
+		return fmt.Errorf("heatmap needs xcol set to the time column")
+	}
+	if len(getLogsResp.Logs) > 0 {
+		if _, ok := getLogsResp.Logs[0][queryInfo.Xcol]; !ok {
+			return fmt.Errorf("time column %s is not in the query result", queryInfo.Xcol)
+		}
+	}
+	ds.BuildHeatmap(getLogsResp.Logs, queryInfo.Xcol, ycols[0], ycols[1], parser, frames)
+	appendNotices(*frames, parser.Notices()...)
+	return nil
+}
+
+// QueryHistogram runs a query and buckets the numeric ycol columns into a distribution.
+func (ds *SlsDatasource) QueryHistogram(client *sls.Client, logSource *LogSource, queryInfo *QueryInfo,
+	from int64, to int64, frames *data.Frames) error {
+	bounds, err := parseBucketBounds(queryInfo.Buckets)
+	if err != nil {
+		return err
+	}
+	getLogsResp, err := client.GetLogs(logSource.Project, logSource.LogStore, "",
+		from, to, queryInfo.Query, queryInfo.LogsPerPage, 0, true)
+	if err != nil {
+		log.DefaultLogger.Error("QueryHistogram", "query", queryInfo.Query, "error", err)
+		return err
+	}
+	ycols := splitColumns(queryInfo.Ycol)
+	if len(ycols) == 0 {
+		return fmt.Errorf("histogram needs ycol set to the numeric columns")
+	}
+	ds.BuildHistogram(getLogsResp.Logs, ycols, bounds, frames)
+	return nil
+}
+
+// BuildHeatmap
+// returns a heatmap-rows frame: one row per time and one count field per bucket, ordered
+// by bounds and named by their upper bound, the le of Prometheus histograms. Buckets are
+// ranges such as 0-100, [100,200) or >1000, or single upper bounds whose lower bound is the
+// previous bucket. Counts of the same time and bucket are summed, missing ones are null.
+func (ds *SlsDatasource) BuildHeatmap(logs []map[string]string, xcol string, bucketCol string, countCol string,
+	parser *TimeParser, frames *data.Frames) {
+	type row struct {
+		time   time.Time
+		counts map[string]*float64
+	}
+	var rows []*row
+	index := make(map[int64]*row)
+	labels := make(map[string]bool)
+	for _, alog := range logs {
+		t, ok := parser.ParseColumn(xcol, alog[xcol])
+		if !ok {
+			continue
+		}
+		r, ok := index[t.UnixNano()]
+		if !ok {
+			r = &row{time: t, counts: make(map[string]*float64)}
+			index[t.UnixNano()] = r
+			rows = append(rows, r)
+		}
+		bucket := strings.TrimSpace(alog[bucketCol])
+		r.counts[bucket] = addNullable(r.counts[bucket], parseNullableFloat("BuildHeatmap", alog[countCol]))
+		labels[bucket] = true
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].time.Before(rows[j].time) })
+
+	// labels with the same bounds share a field
+	bounds, invalid := heatmapBuckets(labels)
+	fieldLabels := make(map[[2]float64][]string)
+	var fieldBounds [][2]float64
+	for label, b := range bounds {
+		if _, ok := fieldLabels[b]; !ok {
+			fieldBounds = append(fieldBounds, b)
+		}
+		fieldLabels[b] = append(fieldLabels[b], label)
+	}
+	sort.Slice(fieldBounds, func(i, j int) bool {
+		if fieldBounds[i][1] != fieldBounds[j][1] {
+			return fieldBounds[i][1] < fieldBounds[j][1]
+		}
+		return fieldBounds[i][0] < fieldBounds[j][0]
+	})
+
+	times := make([]time.Time, 0, len(rows))
+	for _, r := range rows {
+		times = append(times, r.time)
+	}
+	frame := data.NewFrame("heatmap", data.NewField(xcol, nil, times))
+	for _, b := range fieldBounds {
+		counts := make([]*float64, 0, len(rows))
+		for _, r := range rows {
+			var count *float64
+			for _, label := range fieldLabels[b] {
+				if c, ok := r.counts[label]; ok {
+					count = addNullable(count, c)
+				}
+			}
+			counts = append(counts, count)
+		}
+		frame.Fields = append(frame.Fields, data.NewField(strconv.FormatFloat(b[1], 'f', -1, 64), nil, counts))
+	}
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		frame.Meta = &data.FrameMeta{Notices: []data.Notice{{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("%d bucket(s) of column %s are not numeric ranges and were skipped, e.g. %q", len(invalid), bucketCol, invalid[0]),
+		}}}
+	}
+	*frames = append(*frames, frame)
+}
+
+// heatmapBuckets returns the [lower, upper] bounds of every bucket label and the labels
+// that could not be parsed. Missing lower bounds are taken from the previous upper bound,
+// open upper bounds get the width of the previous bucket.
+func heatmapBuckets(labels map[string]bool) (map[string][2]float64, []string) {
+	type bucket struct {
+		label        string
+		lower, upper float64
+	}
+	var buckets []*bucket
+	var invalid []string
+	for label := range labels {
+		lower, upper, err := parseBucket(label)
+		if err != nil {
+			invalid = append(invalid, label)
+			continue
+		}
+		buckets = append(buckets, &bucket{label: label, lower: lower, upper: upper})
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		if buckets[i].upper != buckets[j].upper {
+			return buckets[i].upper < buckets[j].upper
+		}
+		return buckets[i].lower < buckets[j].lower
+	})
+	bounds := make(map[string][2]float64, len(buckets))
+	for i, b := range buckets {
+		if math.IsInf(b.lower, -1) {
+			b.lower = 0
+			if i > 0 {
+				b.lower = buckets[i-1].upper
+			} else if b.upper < 0 {
+				b.lower = b.upper
+			}
+		}
+		if math.IsInf(b.upper, 1) {
+			width := 1.0
+			if i > 0 && buckets[i-1].upper > buckets[i-1].lower {
+				width = buckets[i-1].upper - buckets[i-1].lower
+			}
+			b.upper = b.lower + width
+		}
+		bounds[b.label] = [2]float64{b.lower, b.upper}
+	}
+	return bounds, invalid
+}
+
+// parseBucket parses a bucket label: "100" or "<100" (upper bound only), ">1000" (lower
+// bound only), or a range "0-100", "0~100", "0 to 100", "[0,100)". A missing bound is infinite.
+func parseBucket(label string) (float64, float64, error) {
+	s := strings.Trim(strings.TrimSpace(label), "[]()")
+	switch {
+	case strings.HasPrefix(s, "<="), strings.HasPrefix(s, "<"):
+		upper, err := parseBound(strings.TrimLeft(s, "<="))
+		return math.Inf(-1), upper, err
+	case strings.HasPrefix(s, ">="), strings.HasPrefix(s, ">"):
+		lower, err := parseBound(strings.TrimLeft(s, ">="))
+		return lower, math.Inf(1), err
+	}
+	for _, sep := range []string{",", "~", " to "} {
+		if i := strings.Index(s, sep); i > 0 {
+			return parseRange(s[:i], s[i+len(sep):])
+		}
+	}
+	// a leading minus is the sign of the lower bound, a minus after e is an exponent
+	for i := 1; i < len(s); i++ {
+		if s[i] == '-' && s[i-1] != 'e' && s[i-1] != 'E' {
+			return parseRange(s[:i], s[i+1:])
+		}
+	}
+	upper, err := parseBound(s)
+	return math.Inf(-1), upper, err
+}
+
+func parseRange(lower string, upper string) (float64, float64, error) {
+	l, err := parseBound(lower)
+	if err != nil {
+		return 0, 0, err
+	}
+	u, err := parseBound(upper)
+	if err != nil {
+		return 0, 0, err
+	}
+	if u < l {
+		return 0, 0, fmt.Errorf("invalid bucket %s-%s", lower, upper)
+	}
+	return l, u, nil
+}
+
+func parseBound(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	switch strings.ToLower(strings.TrimPrefix(s, "+")) {
+	case "inf", "infinity":
+		return math.Inf(1), nil
+	case "-inf", "-infinity":
+		return math.Inf(-1), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, fmt.Errorf("invalid bucket bound %q", s)
+	}
+	return f, nil
+}
+
+// parseBucketBounds parses comma separated ascending histogram bounds, empty means automatic.
+func parseBucketBounds(s string) ([]float64, error) {
+	var bounds []float64
+	for _, v := range splitColumns(s) {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket bound %q", v)
+		}
+		if len(bounds) > 0 && f <= bounds[len(bounds)-1] {
+			return nil, fmt.Errorf("bucket bounds must be ascending: %s", s)
+		}
+		bounds = append(bounds, f)
+	}
+	if len(bounds) == 1 {
+		return nil, fmt.Errorf("at least two bucket bounds are needed: %s", s)
+	}
+	return bounds, nil
+}
+
+// BuildHistogram
+// counts the values of every ycol into buckets and returns xMin, xMax and one count
+// field per column. Without bounds, equal buckets of a rounded width covering all
+// values are used. Values outside explicit bounds are reported in a notice.
+func (ds *SlsDatasource) BuildHistogram(logs []map[string]string, ycols []string, bounds []float64, frames *data.Frames) {
+	values := make([][]float64, len(ycols))
+	for i, ycol := range ycols {
+		for _, alog := range logs {
+			if f := parseNullableFloat("BuildHistogram", alog[ycol]); f != nil && !math.IsInf(*f, 0) {
+				values[i] = append(values[i], *f)
+			}
+		}
+	}
+	if len(bounds) == 0 {
+		bounds = autoBucketBounds(values)
+	}
+	frame := data.NewFrame("histogram")
+	if len(bounds) < 2 {
+		*frames = append(*frames, frame)
+		return
+	}
+	frame.Fields = append(frame.Fields,
+		data.NewField("xMin", nil, append([]float64(nil), bounds[:len(bounds)-1]...)),
+		data.NewField("xMax", nil, append([]float64(nil), bounds[1:]...)),
+	)
+	outside := 0
+	for i, ycol := range ycols {
+		counts := make([]float64, len(bounds)-1)
+		for _, v := range values[i] {
+			if j := histogramBucket(bounds, v); j >= 0 {
+				counts[j]++
+			} else {
+				outside++
+			}
+		}
+		name := "count"
+		if len(ycols) > 1 {
+			name = ycol
+		}
+		frame.Fields = append(frame.Fields, data.NewField(name, nil, counts))
+	}
+	if outside > 0 {
+		frame.Meta = &data.FrameMeta{Notices: []data.Notice{{
+			Severity: data.NoticeSeverityInfo,
+			Text:     fmt.Sprintf("%d value(s) outside of the bucket bounds were not counted", outside),
+		}}}
+	}
+	*frames = append(*frames, frame)
+}
+
+// histogramBucket returns the bucket [bounds[j], bounds[j+1]) holding v, the last
+// bucket includes its upper bound, or -1 when v is outside of the bounds.
+func histogramBucket(bounds []float64, v float64) int {
+	last := len(bounds) - 1
+	if v < bounds[0] || v > bounds[last] {
+		return -1
+	}
+	if v == bounds[last] {
+		return last - 1
+	}
+	return sort.Search(last, func(j int) bool { return bounds[j+1] > v })
+}
+
+// autoBucketBounds returns about sqrt(n) buckets, at most histogramMaxBuckets,
+// of a 1, 2 or 5 times power of ten width covering all values.
+func autoBucketBounds(values [][]float64) []float64 {
+	n := 0
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, column := range values {
+		for _, v := range column {
+			lo = math.Min(lo, v)
+			hi = math.Max(hi, v)
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	if lo == hi {
+		return []float64{lo, lo + 1}
+	}
+	count := math.Min(math.Ceil(math.Sqrt(float64(n))), histogramMaxBuckets)
+	raw := (hi - lo) / count
+	magnitude := math.Pow(10, math.Floor(math.Log10(raw)))
+	width := magnitude * 10
+	for _, m := range []float64{1, 2, 5} {
+		if magnitude*m >= raw {
+			width = magnitude * m
+			break
+		}
+	}
+	start := math.Floor(lo/width) * width
+	var bounds []float64
+	for i := 0; ; i++ {
+		b := start + float64(i)*width
+		bounds = append(bounds, b)
+		if b > hi {
+			break
+		}
+	}
+	return bounds
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+const (
+	// indexCacheTTL is how long the index configuration of a logstore is reused.
+	indexCacheTTL = 5 * time.Minute
+
+	IndexTypeText   = "text"
+	IndexTypeLong   = "long"
+	IndexTypeDouble = "double"
+	IndexTypeJSON   = "json"
+
+	// indexNotExist is the SLS error code of a logstore without index.
+	indexNotExist = "IndexConfigNotExist"
+)
+
+// LogStoreIndex is the index configuration of a logstore.
+type LogStoreIndex struct {
+	FullText *FullTextIndex `json:"fullText"`
+	Keys     []IndexField   `json:"keys"`
+}
+
+// FullTextIndex is the full-text index settings of a logstore.
+type FullTextIndex struct {
+	CaseSensitive bool     `json:"caseSensitive"`
+	Chinese       bool     `json:"chinese"`
+	Tokens        []string `json:"tokens"`
+	IncludeKeys   []string `json:"includeKeys,omitempty"`
+	ExcludeKeys   []string `json:"excludeKeys,omitempty"`
+}
+
+// IndexField is an indexed key, JSON sub-keys are named parent.sub.
+type IndexField struct {
+	Name      string       `json:"name"`
+	Type      string       `json:"type"`
+	Alias     string       `json:"alias,omitempty"`
+	Analytics bool         `json:"analytics"`
+	JSONKeys  []IndexField `json:"jsonKeys,omitempty"`
+}
+
+// newLogStoreIndex converts the SLS index configuration, keys sorted by name.
+func newLogStoreIndex(index *sls.Index) *LogStoreIndex {
+	idx := &LogStoreIndex{Keys: []IndexField{}}
+	if index == nil {
+		return idx
+	}
+	if index.Line != nil {
+		idx.FullText = &FullTextIndex{
+			CaseSensitive: index.Line.CaseSensitive,
+			Chinese:       index.Line.Chn,
+			Tokens:        index.Line.Token,
+			IncludeKeys:   index.Line.IncludeKeys,
+			ExcludeKeys:   index.Line.ExcludeKeys,
+		}
+	}
+	for name, key := range index.Keys {
+		field := IndexField{Name: name, Type: key.Type, Alias: key.Alias, Analytics: key.DocValue}
+		for sub, jsonKey := range key.JsonKeys {
+			field.JSONKeys = append(field.JSONKeys, IndexField{
+				Name:      name + "." + sub,
+				Type:      jsonKey.Type,
+				Alias:     jsonKey.Alias,
+				Analytics: jsonKey.DocValue,
+			})
+		}
+		sort.Slice(field.JSONKeys, func(i, j int) bool { return field.JSONKeys[i].Name < field.JSONKeys[j].Name })
+		idx.Keys = append(idx.Keys, field)
+	}
+	sort.Slice(idx.Keys, func(i, j int) bool { return idx.Keys[i].Name < idx.Keys[j].Name })
+	return idx
+}
+
+// FieldTypes returns the type of every indexed key and JSON sub-key, also under their aliases.
+func (idx *LogStoreIndex) FieldTypes() map[string]string {
+	types := make(map[string]string)
+	var add func(fields []IndexField)
+	add = func(fields []IndexField) {
+		for _, f := range fields {
+			types[f.Name] = f.Type
+			if f.Alias != "" {
+				types[f.Alias] = f.Type
+			}
+			add(f.JSONKeys)
+		}
+	}
+	add(idx.Keys)
+	return types
+}
+
+// analyticFields returns whether every indexed key and JSON sub-key, also under their aliases,
+// is enabled for analytics.
+func (idx *LogStoreIndex) analyticFields() map[string]bool {
+	analytics := make(map[string]bool)
+	var add func(fields []IndexField)
+	add = func(fields []IndexField) {
+		for _, f := range fields {
+			analytics[f.Name] = f.Analytics
+			if f.Alias != "" {
+				analytics[f.Alias] = f.Analytics
+			}
+			add(f.JSONKeys)
+		}
+	}
+	add(idx.Keys)
+	return analytics
+}
+
+// indexEntry is a cached index read, errors returned by SLS are cached too so that a logstore
+// without index permission is not asked again on every query.
+type indexEntry struct {
+	index *LogStoreIndex
+	err   error
+}
+
+// GetIndex returns the index configuration of the logstore, cached for indexCacheTTL.
+// A logstore without index has no keys and no full-text settings.
+func (ds *SlsDatasource) GetIndex(logSource *LogSource, project string, logstore string) (*LogStoreIndex, error) {
+	entry, err := ds.indexCache.Get(logSource.UID+"/"+project+"/"+logstore, func() (interface{}, error) {
+		index, err := NewClient(logSource).GetIndex(project, logstore)
+		if err != nil {
+			e, ok := err.(*sls.Error)
+			if ok && e.Code == indexNotExist {
+				return &indexEntry{index: newLogStoreIndex(nil)}, nil
+			}
+			if ok && e.HTTPCode < http.StatusInternalServerError {
+				return &indexEntry{err: err}, nil
+			}
+			return nil, err
+		}
+		return &indexEntry{index: newLogStoreIndex(index)}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry.(*indexEntry).index, entry.(*indexEntry).err
+}
+
+// fieldTypes returns the index types of the fields of the logstore of logSource,
+// or nil when the index cannot be read.
+func (ds *SlsDatasource) fieldTypes(logSource *LogSource) map[string]string {
+	idx, err := ds.GetIndex(logSource, logSource.Project, logSource.LogStore)
+	if err != nil {
+		log.DefaultLogger.Error("fieldTypes", "project", logSource.Project, "logstore", logSource.LogStore, "error", err)
+		return nil
+	}
+	return idx.FieldTypes()
+}
+
+// isNumericType reports whether values of the index type are numbers.
+func isNumericType(t string) bool {
+	return t == IndexTypeLong || t == IndexTypeDouble
+}
+
+// handleIndex returns the index configuration of a logstore.
+// Parameters: project and logstore, the datasource ones by default.
+func (ds *SlsDatasource) handleIndex(w http.ResponseWriter, r *http.Request) {
+	logSource, ok := resourceSettings(w, r)
+	if !ok {
+		return
+	}
+	project, logstore := resourceLogStore(logSource, r)
+	if !logSource.logStoreAllowed(project, logstore) {
+		writeResourceError(w, http.StatusForbidden, fmt.Errorf("logstore %s/%s is not allowed", project, logstore))
+		return
+	}
+	idx, err := ds.GetIndex(logSource, project, logstore)
+	if err != nil {
+		writeResourceError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, idx)
+}
+
+// resourceLogStore returns the project and logstore parameters of a resource call,
+// defaulting to the datasource settings.
+func resourceLogStore(logSource *LogSource, r *http.Request) (string, string) {
+	project := strings.TrimSpace(r.URL.Query().Get("project"))
+	logstore := strings.TrimSpace(r.URL.Query().Get("logstore"))
+	if project == "" {
+		project = logSource.Project
+	}
+	if logstore == "" {
+		logstore = logSource.LogStore
+	}
+	return project, logstore
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	// defaultMaxDataPoints is used to pick the interval when the query does not carry MaxDataPoints.
+	defaultMaxDataPoints = 1000
+
+	// autoIntervalVariable is replaced by the auto interval as an SLS duration, e.g. 1m for time_series.
+	autoIntervalVariable = "$__auto_interval"
+	// autoIntervalSecondsVariable is replaced by the auto interval in seconds, e.g. __time__ - __time__ % $__auto_interval_s.
+	autoIntervalSecondsVariable = "$__auto_interval_s"
+)
+
+const (
+	// DownsampleAvg averages the values of a bucket, the default.
+	DownsampleAvg = "avg"
+	// DownsampleMax keeps the largest value of a bucket.
+	DownsampleMax = "max"
+	// DownsampleMin keeps the smallest value of a bucket.
+	DownsampleMin = "min"
+	// DownsampleSum sums the values of a bucket.
+	DownsampleSum = "sum"
+	// DownsampleLast keeps the last value of a bucket.
+	DownsampleLast = "last"
+)
+
+// niceIntervals are the bucket sizes the auto interval is rounded up to.
+var niceIntervals = []time.Duration{
+	time.Second, 5 * time.Second, 10 * time.Second, 15 * time.Second, 30 * time.Second,
+	time.Minute, 5 * time.Minute, 10 * time.Minute, 15 * time.Minute, 30 * time.Minute,
+	time.Hour, 2 * time.Hour, 3 * time.Hour, 6 * time.Hour, 12 * time.Hour, 24 * time.Hour,
+}
+
+// autoInterval returns the bucket size giving at most MaxDataPoints points over the
+// time range of the query, rounded up to a nice interval and never below query.Interval.
+func autoInterval(query backend.DataQuery) time.Duration {
+	points := query.MaxDataPoints
+	if points <= 0 {
+		points = defaultMaxDataPoints
+	}
+	interval := query.TimeRange.Duration() / time.Duration(points)
+	if interval < query.Interval {
+		interval = query.Interval
+	}
+	for _, nice := range niceIntervals {
+		if nice >= interval {
+			return nice
+		}
+	}
+	day := 24 * time.Hour
+	return (interval + day - 1) / day * day
+}
+
+// formatInterval renders d as an SLS duration such as 30s, 5m, 2h or 1d.
+func formatInterval(d time.Duration) string {
+	seconds := int64(d / time.Second)
+	switch {
+	case seconds >= 86400 && seconds%86400 == 0:
+		return strconv.FormatInt(seconds/86400, 10) + "d"
+	case seconds >= 3600 && seconds%3600 == 0:
+		return strconv.FormatInt(seconds/3600, 10) + "h"
+	case seconds >= 60 && seconds%60 == 0:
+		return strconv.FormatInt(seconds/60, 10) + "m"
+	default:
+		return strconv.FormatInt(seconds, 10) + "s"
+	}
+}
+
+// expandIntervalVariables replaces the auto interval variables of query.
+func expandIntervalVariables(query string, interval time.Duration) string {
+	query = strings.ReplaceAll(query, autoIntervalSecondsVariable, strconv.FormatInt(int64(interval/time.Second), 10))
+	return strings.ReplaceAll(query, autoIntervalVariable, formatInterval(interval))
+}
+
+// downsampleFrames reduces the frames having a time field and more than maxPoints rows
+// to one row per interval bucket, aggregating numeric fields with mode.
+func downsampleFrames(frames data.Frames, maxPoints int64, interval time.Duration, mode string) {
+	if maxPoints <= 0 {
+		return
+	}
+	for i, frame := range frames {
+		rows, _ := frame.RowLen()
+		if int64(rows) <= maxPoints {
+			continue
+		}
+		if downsampled := downsampleFrame(frame, interval, mode); downsampled != nil {
+			downsampled.Meta = frame.Meta
+			if downsampled.Meta == nil {
+				downsampled.Meta = &data.FrameMeta{}
+			}
+			n, _ := downsampled.RowLen()
+			downsampled.Meta.Notices = append(downsampled.Meta.Notices, data.Notice{
+				Severity: data.NoticeSeverityInfo,
+				Text:     fmt.Sprintf("%d points were downsampled to %d with %s over %s", rows, n, downsampleMode(mode), formatInterval(interval)),
+			})
+			frames[i] = downsampled
+		}
+	}
+}
+
+// downsampleMode returns mode, or DownsampleAvg when mode is empty or unknown.
+func downsampleMode(mode string) string {
+	switch mode {
+	case DownsampleMax, DownsampleMin, DownsampleSum, DownsampleLast:
+		return mode
+	}
+	return DownsampleAvg
+}
+
+// downsampleFrame returns frame with one row per interval bucket of its first time field,
+// in order of first appearance, or nil when frame has no time field.
+func downsampleFrame(frame *data.Frame, interval time.Duration, mode string) *data.Frame {
+	timeIndex := -1
+	for i, field := range frame.Fields {
+		if field.Type().Time() {
+			timeIndex = i
+			break
+		}
+	}
+	if timeIndex < 0 || interval <= 0 {
+		return nil
+	}
+	rows, _ := frame.RowLen()
+
+	var buckets []time.Time
+	var members [][]int
+	index := make(map[int64]int)
+	for row := 0; row < rows; row++ {
+		v, ok := frame.Fields[timeIndex].ConcreteAt(row)
+		if !ok {
+			continue
+		}
+		bucket := v.(time.Time).Truncate(interval)
+		b, ok := index[bucket.UnixNano()]
+		if !ok {
+			b = len(buckets)
+			index[bucket.UnixNano()] = b
+			buckets = append(buckets, bucket)
+			members = append(members, nil)
+		}
+		members[b] = append(members[b], row)
+	}
+
+	downsampled := data.NewFrame(frame.Name)
+	for i, field := range frame.Fields {
+		var out *data.Field
+		switch {
+		case i == timeIndex:
+			out = data.NewField(field.Name, field.Labels, buckets)
+		case field.Type().Numeric():
+			values := make([]*float64, 0, len(buckets))
+			for _, rows := range members {
+				values = append(values, aggregateRows(field, rows, mode))
+			}
+			out = data.NewField(field.Name, field.Labels, values)
+		default:
+			out = data.NewFieldFromFieldType(field.Type(), len(buckets))
+			out.Name = field.Name
+			out.Labels = field.Labels
+			for b, rows := range members {
+				out.Set(b, field.CopyAt(rows[len(rows)-1]))
+			}
+		}
+		out.Config = field.Config
+		downsampled.Fields = append(downsampled.Fields, out)
+	}
+	return downsampled
+}
+
+// aggregateRows aggregates the non null values of field at rows, nil when all are null.
+func aggregateRows(field *data.Field, rows []int, mode string) *float64 {
+	mode = downsampleMode(mode)
+	var result *float64
+	count := 0
+	for _, row := range rows {
+		f, err := field.FloatAt(row)
+		if err != nil || math.IsNaN(f) {
+			continue
+		}
+		count++
+		if result == nil {
+			v := f
+			result = &v
+			continue
+		}
+		switch mode {
+		case DownsampleMax:
+			*result = math.Max(*result, f)
+		case DownsampleMin:
+			*result = math.Min(*result, f)
+		case DownsampleLast:
+			*result = f
+		default:
+			*result += f
+		}
+	}
+	if result != nil && mode == DownsampleAvg {
+		*result /= float64(count)
+	}
+	return result
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	// QueryModeLive marks the queries of Explore Live mode, answered with a tail channel.
+	QueryModeLive = "live"
+
+	// tailPollInterval is the delay between two pulls of every shard.
+	tailPollInterval = time.Second
+	// tailShardRefresh is the delay between two listings of the shards, to follow splits and merges.
+	tailShardRefresh = 30 * time.Second
+	// tailLogGroups bounds the log groups pulled from a shard at once.
+	tailLogGroups = 100
+	// tailMaxLines bounds the lines sent in one frame.
+	tailMaxLines = 1000
+)
+
+// tailParams are the parameters of a live tail stream.
+type tailParams struct {
+	Filter string `json:"filter"`
+}
+
+// tailChannel registers a live tail of logSource with the search of queryInfo and returns its
+// channel, or an error when the search uses syntax the tail cannot filter with.
+func (ds *SlsDatasource) tailChannel(logSource *LogSource, queryInfo *QueryInfo) (string, error) {
+	filter := strings.TrimSpace(queryInfo.Query)
+	if filter == "*" {
+		filter = ""
+	}
+	if _, err := newLogFilter(filter); err != nil {
+		return "", err
+	}
+	params, _ := json.Marshal(&tailParams{Filter: filter})
+	return ds.registerStream(logSource, streamKindTail, params), nil
+}
+
+// filterTerm is a key:value condition or, without key, a term searched in every field.
+type filterTerm struct {
+	key   string
+	value string
+}
+
+// filterExpr is a node of a parsed filter: a term when op is empty, else the and, or or not of children.
+type filterExpr struct {
+	op       string
+	children []*filterExpr
+	term     filterTerm
+}
+
+// logFilter matches pulled logs against a subset of the SLS search syntax: terms, key:value
+// conditions and quoted phrases combined with and (or spaces), or, not and parentheses.
+// Matching is case insensitive.
+type logFilter struct {
+	root *filterExpr
+}
+
+// newLogFilter parses query, failing on the parts of the search syntax it cannot evaluate
+// such as numeric comparisons, in, or an analytic query.
+func newLogFilter(query string) (*logFilter, error) {
+	tokens, err := tokenizeFilter(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return &logFilter{}, nil
+	}
+	p := &filterParser{tokens: tokens}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("live tail cannot filter with %s: unexpected %q", query, p.tokens[p.pos])
+	}
+	return &logFilter{root: root}, nil
+}
+
+// filterParser is a recursive descent parser of filter tokens, or binding looser than and.
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return strings.ToLower(p.tokens[p.pos])
+	}
+	return ""
+}
+
+func (p *filterParser) or() (*filterExpr, error) {
+	return p.list("or", p.and)
+}
+
+func (p *filterParser) and() (*filterExpr, error) {
+	return p.list("and", p.not)
+}
+
+// list parses operands joined by op, and also joins operands that simply follow each other.
+func (p *filterParser) list(op string, operand func() (*filterExpr, error)) (*filterExpr, error) {
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	expr := &filterExpr{op: op, children: []*filterExpr{first}}
+	for {
+		next := p.peek()
+		if next == op {
+			p.pos++
+		} else if op == "or" || next == "" || next == ")" || next == "or" {
+			break
+		}
+		child, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		expr.children = append(expr.children, child)
+	}
+	if len(expr.children) == 1 {
+		return first, nil
+	}
+	return expr, nil
+}
+
+func (p *filterParser) not() (*filterExpr, error) {
+	if p.peek() == "not" {
+		p.pos++
+		child, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &filterExpr{op: "not", children: []*filterExpr{child}}, nil
+	}
+	return p.primary()
+}
+
+func (p *filterParser) primary() (*filterExpr, error) {
+	switch p.peek() {
+	case "":
+		return nil, fmt.Errorf("live tail filter ends unexpectedly")
+	case "(":
+		p.pos++
+		expr, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("live tail filter misses a )")
+		}
+		p.pos++
+		return expr, nil
+	case ")", "and", "or":
+		return nil, fmt.Errorf("live tail filter has an unexpected %s", p.tokens[p.pos])
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+	term := filterTerm{value: token}
+	if i := strings.Index(token, ":"); i > 0 && !strings.HasPrefix(token, `"`) {
+		term.key = strings.TrimSpace(token[:i])
+		term.value = strings.TrimSpace(token[i+1:])
+	}
+	term.value = strings.ToLower(strings.Trim(strings.Trim(term.value, `"`), "*"))
+	return &filterExpr{term: term}, nil
+}
+
+// tokenizeFilter splits on spaces and parentheses outside of quotes, key: "value" stays one token.
+// Comparisons and in are rejected, the tail matches text only.
+func tokenizeFilter(query string) ([]string, error) {
+	var tokens []string
+	var b strings.Builder
+	quoted := false
+	flush := func() {
+		if s := b.String(); s != "" && !strings.HasSuffix(s, ":") {
+			tokens = append(tokens, s)
+			b.Reset()
+		}
+	}
+	for _, r := range query {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			b.WriteRune(r)
+		case quoted:
+			b.WriteRune(r)
+		case r == ' ' || r == '\t' || r == '\n':
+			flush()
+		case r == '(' || r == ')':
+			flush()
+			if b.Len() > 0 {
+				// a key: followed by a parenthesis
+				return nil, fmt.Errorf("live tail cannot filter with %s: %s needs a value", query, b.String())
+			}
+			tokens = append(tokens, string(r))
+		case strings.ContainsRune("<>=|[]", r):
+			return nil, fmt.Errorf("live tail cannot filter with %s: %q is not supported, use terms, key: value, and, or, not and parentheses", query, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("live tail cannot filter with %s: unterminated quote", query)
+	}
+	flush()
+	if b.Len() > 0 {
+		return nil, fmt.Errorf("live tail cannot filter with %s: %s needs a value", query, b.String())
+	}
+	for _, token := range tokens {
+		if strings.EqualFold(token, "in") {
+			return nil, fmt.Errorf("live tail cannot filter with %s: in is not supported", query)
+		}
+	}
+	return tokens, nil
+}
+
+// Match reports whether alog satisfies the filter.
+func (f *logFilter) Match(alog map[string]string) bool {
+	return f.root == nil || f.root.match(alog)
+}
+
+func (e *filterExpr) match(alog map[string]string) bool {
+	switch e.op {
+	case "and":
+		for _, c := range e.children {
+			if !c.match(alog) {
+				return false
+			}
+		}
+		return true
+	case "or":
+		for _, c := range e.children {
+			if c.match(alog) {
+				return true
+			}
+		}
+		return false
+	case "not":
+		return !e.children[0].match(alog)
+	}
+	if e.term.value == "" {
+		return true
+	}
+	if e.term.key != "" {
+		return strings.Contains(strings.ToLower(alog[e.term.key]), e.term.value)
+	}
+	for k, v := range alog {
+		if k != "__time__" && strings.Contains(strings.ToLower(v), e.term.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// shardCursor is the read position of one shard, lastTime the time of the last log read.
+type shardCursor struct {
+	cursor   string
+	readOnly bool
+	lastTime uint32
+}
+
+// logTail pulls new logs from every shard of a logstore.
+type logTail struct {
+	client  *sls.Client
+	path    *streamPath
+	filter  *logFilter
+	started time.Time
+	shards  map[int]*shardCursor
+	// finished are the shards drained or removed, never read again
+	finished map[int]bool
+}
+
+// refreshShards follows shard splits and merges: shards created after the tail started are
+// read from their beginning, others from their end; read only shards are read until drained
+// and then finished.
+func (t *logTail) refreshShards() error {
+	shards, err := t.client.ListShards(t.path.Project, t.path.LogStore)
+	if err != nil {
+		return err
+	}
+	for _, shard := range shards {
+		if t.finished[shard.ShardID] {
+			continue
+		}
+		readOnly := strings.EqualFold(shard.Status, "readonly")
+		if sc, ok := t.shards[shard.ShardID]; ok {
+			sc.readOnly = readOnly
+			continue
+		}
+		from := "end"
+		if int64(shard.CreateTime) > t.started.Unix() {
+			from = "begin"
+		} else if readOnly {
+			// a read only shard existing before the tail has nothing new
+			continue
+		}
+		cursor, err := t.client.GetCursor(t.path.Project, t.path.LogStore, shard.ShardID, from)
+		if err != nil {
+			return err
+		}
+		t.shards[shard.ShardID] = &shardCursor{cursor: cursor, readOnly: readOnly}
+	}
+	return nil
+}
+
+// resetCursor moves an expired cursor of shard id to the time of the last log read, to the
+// end of the shard when none was read, rather than replaying the shard.
+func (t *logTail) resetCursor(id int, sc *shardCursor) {
+	from := "end"
+	if sc.lastTime > 0 {
+		from = strconv.FormatUint(uint64(sc.lastTime), 10)
+	}
+	cursor, err := t.client.GetCursor(t.path.Project, t.path.LogStore, id, from)
+	if err != nil {
+		log.DefaultLogger.Error("GetCursor", "shard", id, "from", from, "error", err)
+		return
+	}
+	sc.cursor = cursor
+}
+
+// pull returns the new logs of every shard matching the filter, oldest first.
+// It reports whether the shards changed and should be listed again.
+func (t *logTail) pull() ([]map[string]string, bool) {
+	var logs []map[string]string
+	changed := false
+	for id, sc := range t.shards {
+		gl, next, err := t.client.PullLogs(t.path.Project, t.path.LogStore, id, sc.cursor, "", tailLogGroups)
+		if err != nil {
+			log.DefaultLogger.Error("PullLogs", "shard", id, "error", err)
+			if strings.Contains(err.Error(), sls.SHARD_NOT_EXIST) {
+				delete(t.shards, id)
+				t.finished[id] = true
+				changed = true
+			} else if strings.Contains(err.Error(), sls.INVALID_CURSOR) {
+				t.resetCursor(id, sc)
+			}
+			continue
+		}
+		if next == sc.cursor && sc.readOnly {
+			// drained after a split or merge, its children hold the new logs
+			delete(t.shards, id)
+			t.finished[id] = true
+			changed = true
+			continue
+		}
+		sc.cursor = next
+		if gl == nil {
+			continue
+		}
+		for _, group := range gl.LogGroups {
+			for _, l := range group.Logs {
+				if l.GetTime() > sc.lastTime {
+					sc.lastTime = l.GetTime()
+				}
+				alog := map[string]string{"__time__": strconv.FormatUint(uint64(l.GetTime()), 10)}
+				if group.Source != nil {
+					alog["__source__"] = group.GetSource()
+				}
+				if group.Topic != nil && group.GetTopic() != "" {
+					alog["__topic__"] = group.GetTopic()
+				}
+				for _, c := range l.Contents {
+					alog[c.GetKey()] = c.GetValue()
+				}
+				if t.filter.Match(alog) {
+					logs = append(logs, alog)
+				}
+			}
+		}
+	}
+	sort.SliceStable(logs, func(i, j int) bool {
+		ti, _ := strconv.ParseInt(logs[i]["__time__"], 10, 64)
+		tj, _ := strconv.ParseInt(logs[j]["__time__"], 10, 64)
+		return ti < tj
+	})
+	return logs, changed
+}
+
+// TailLogs sends the new logs of the stream path matching the filter of params as logs frames until ctx is done.
+func (ds *SlsDatasource) TailLogs(ctx context.Context, client *sls.Client, logSource *LogSource, path *streamPath,
+	params *tailParams, sender *backend.StreamSender) error {
+	filter, err := newLogFilter(params.Filter)
+	if err != nil {
+		return err
+	}
+	t := &logTail{
+		client:   client,
+		path:     path,
+		filter:   filter,
+		started:  time.Now(),
+		shards:   make(map[int]*shardCursor),
+		finished: make(map[int]bool),
+	}
+	if err := t.refreshShards(); err != nil {
+		log.DefaultLogger.Error("TailLogs", "path", path.String(), "error", err)
+		return err
+	}
+	refreshed := time.Now()
+	ticker := time.NewTicker(tailPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.DefaultLogger.Info("Context done, finish streaming", "path", path.String())
+			return nil
+		case <-ticker.C:
+			logs, changed := t.pull()
+			if changed || time.Since(refreshed) > tailShardRefresh {
+				if err := t.refreshShards(); err != nil {
+					log.DefaultLogger.Error("TailLogs", "path", path.String(), "error", err)
+				}
+				refreshed = time.Now()
+			}
+			if len(logs) == 0 {
+				continue
+			}
+			if len(logs) > tailMaxLines {
+				logs = logs[len(logs)-tailMaxLines:]
+			}
+			now := time.Now().Unix()
+			var frames data.Frames
+			ds.BuildLogs(logs, nil, logSource, now-3600, now, &frames)
+			if err := sender.SendFrame(frames[0], data.IncludeAll); err != nil {
+				log.DefaultLogger.Error("Error sending frame", "error", err)
+			}
+		}
+	}
+}
@@ -3,28 +3,141 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 )
 
 type LogSource struct {
-	Endpoint        string
-	Project         string `json:"project"`
-	LogStore        string `json:"logstore"`
-	AccessKeyId     string
-	AccessKeySecret string
+	Name             string
+	UID              string
+	Endpoint         string
+	Project          string `json:"project"`
+	LogStore         string `json:"logstore"`
+	AccessKeyId      string
+	AccessKeySecret  string
+	Timezone         string         `json:"timezone"`
+	TraceSchema      TraceSchema    `json:"traceSchema"`
+	DerivedFields    []DerivedField `json:"derivedFields"`
+	GeoIPDatabase    string         `json:"geoipDatabase"`
+	MaxStreams       int            `json:"maxStreams"`
+	StreamRole       string         `json:"streamRole"`
+	AllowedLogStores string         `json:"allowedLogStores"`
+}
+
+// logStoreAllowed reports whether queries and streams may use the logstore: the logstore of
+// the datasource, and those of the allow-list, given as project/logstore, project/* or *.
+func (l *LogSource) logStoreAllowed(project string, logstore string) bool {
+	if project == l.Project && logstore == l.LogStore {
+		return true
+	}
+	for _, a := range splitColumns(l.AllowedLogStores) {
+		if a == "*" || a == project+"/*" || a == project+"/"+logstore {
+			return true
+		}
+	}
+	return false
+}
+
+// projectAllowed reports whether some logstore of project may be used.
+func (l *LogSource) projectAllowed(project string) bool {
+	if project == l.Project {
+		return true
+	}
+	for _, a := range splitColumns(l.AllowedLogStores) {
+		if a == "*" || strings.HasPrefix(a, project+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ForQuery returns the datasource targeting the project and logstore chosen by queryInfo,
+// which must be allowed. Unset ones default to the datasource settings.
+func (l *LogSource) ForQuery(queryInfo *QueryInfo) (*LogSource, error) {
+	if (queryInfo.Project == "" || queryInfo.Project == l.Project) && (queryInfo.LogStore == "" || queryInfo.LogStore == l.LogStore) {
+		return l, nil
+	}
+	target := *l
+	if queryInfo.Project != "" {
+		target.Project = queryInfo.Project
+	}
+	if queryInfo.LogStore != "" {
+		target.LogStore = queryInfo.LogStore
+	}
+	if !l.logStoreAllowed(target.Project, target.LogStore) {
+		return nil, fmt.Errorf("logstore %s/%s is not allowed for this datasource", target.Project, target.LogStore)
+	}
+	return &target, nil
 }
 
 type QueryInfo struct {
-	QueryType   string `json:"type"`
-	QueryMode   string `json:"mode"`
-	Query       string `json:"query"`
-	Xcol        string `json:"xcol"`
-	Ycol        string `json:"ycol"`
-	LogsPerPage int64  `json:"logsPerPage"`
-	CurrentPage int64  `json:"currentPage"`
+	QueryType      string        `json:"type"`
+	QueryMode      string        `json:"mode"`
+	Project        string        `json:"project"`
+	LogStore       string        `json:"logstore"`
+	Query          string        `json:"query"`
+	Xcol           string        `json:"xcol"`
+	Ycol           string        `json:"ycol"`
+	LogsPerPage    int64         `json:"logsPerPage"`
+	CurrentPage    int64         `json:"currentPage"`
+	TraceID        string        `json:"traceId"`
+	Service        string        `json:"service"`
+	Operation      string        `json:"operation"`
+	MinDuration    string        `json:"minDuration"`
+	MaxDuration    string        `json:"maxDuration"`
+	Status         string        `json:"status"`
+	Step           string        `json:"step"`
+	TimeFormat     string        `json:"timeFormat"`
+	NullMode       string        `json:"nullMode"`
+	TopN           int64         `json:"topN"`
+	PieFormat      string        `json:"pieFormat"`
+	Legend         string        `json:"legend"`
+	BarMode        string        `json:"barMode"`
+	Buckets        string        `json:"buckets"`
+	Downsample     string        `json:"downsample"`
+	Chunk          string        `json:"chunk"`
+	TimeShifts     string        `json:"timeShifts"`
+	Compare        string        `json:"compare"`
+	Stream         bool          `json:"stream"`
+	StreamInterval string        `json:"streamInterval"`
+	Latitude       string        `json:"latitude"`
+	Longitude      string        `json:"longitude"`
+	Geohash        string        `json:"geohash"`
+	Country        string        `json:"country"`
+	Province       string        `json:"province"`
+	IP             string        `json:"ip"`
+	TextField      string        `json:"textField"`
+	ValueField     string        `json:"valueField"`
+	Regex          string        `json:"regex"`
+	VariableSort   string        `json:"sort"`
+	AdhocFilters   []AdhocFilter `json:"adhocFilters"`
 }
 
+const (
+	// PieFormatLong returns pie slices as rows of a label and a value field.
+	PieFormatLong = "long"
+	// pieOtherLabel names the slice holding the labels beyond topN.
+	pieOtherLabel = "Other"
+)
+
+const (
+	// BarModeSeries keeps the first category as the bar axis and splits the values
+	// by the other categories into one series each.
+	BarModeSeries = "series"
+)
+
+const (
+	QueryTypeTraceID      = "trace_id"
+	QueryTypeTraceSearch  = "trace_search"
+	QueryTypeServiceGraph = "service_graph"
+	QueryTypeRedMetrics   = "red_metrics"
+	QueryTypeGeo          = "geo"
+	QueryTypeHeatmap      = "heatmap"
+	QueryTypeHistogram    = "histogram"
+	QueryTypeVariable     = "variable"
+)
+
 type Result struct {
 	refId        string
 	dataResponse backend.DataResponse
@@ -45,6 +158,17 @@ func LoadSettings(ctx backend.PluginContext) (*LogSource, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error reading settings: %s", err.Error())
 	}
+	model.TraceSchema, err = model.TraceSchema.Resolve()
+	if err != nil {
+		return nil, fmt.Errorf("error reading settings: %s", err.Error())
+	}
+	for i := range model.DerivedFields {
+		if err = model.DerivedFields[i].Compile(); err != nil {
+			return nil, fmt.Errorf("error reading settings: %s", err.Error())
+		}
+	}
+	model.Name = settings.Name
+	model.UID = settings.UID
 	model.Endpoint = settings.URL
 	model.AccessKeyId = settings.DecryptedSecureJSONData["accessKeyId"]
 	model.AccessKeySecret = settings.DecryptedSecureJSONData["accessKeySecret"]
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+const (
+	// NullModeNull keeps missing values as nulls, the default.
+	NullModeNull = "null"
+	// NullModeZero replaces missing values with 0.
+	NullModeZero = "zero"
+	// NullModeDrop drops rows having a missing value.
+	NullModeDrop = "drop"
+)
+
+// parseNullableFloat parses a numeric value returned by SLS. SLS null, empty
+// strings, NaN and any other non numeric value are missing and return nil.
+func parseNullableFloat(caller string, v string) *float64 {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "", "null", "nan":
+		return nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.DefaultLogger.Error(caller, "ParseFloat", err, "value", v)
+		return nil
+	}
+	if math.IsNaN(f) {
+		return nil
+	}
+	return &f
+}
+
+// nullableValue parses v and applies the null mode to a missing value.
+func nullableValue(caller string, v string, nullMode string) *float64 {
+	f := parseNullableFloat(caller, v)
+	if f == nil && nullMode == NullModeZero {
+		zero := 0.0
+		return &zero
+	}
+	return f
+}
+
+// dropNullRows removes the logs having a missing value in any of cols when
+// nullMode is NullModeDrop, logs are returned unchanged otherwise.
+func dropNullRows(caller string, logs []map[string]string, cols []string, nullMode string) []map[string]string {
+	if nullMode != NullModeDrop {
+		return logs
+	}
+	rows := make([]map[string]string, 0, len(logs))
+	for _, alog := range logs {
+		keep := true
+		for _, col := range cols {
+			if parseNullableFloat(caller, alog[col]) == nil {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			rows = append(rows, alog)
+		}
+	}
+	return rows
+}
+
+// addNullable sums two nullable values, the sum is null only when both are.
+func addNullable(a *float64, b *float64) *float64 {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	sum := *a + *b
+	return &sum
+}
+
+// mapNullable applies f to v, keeping nulls.
+func mapNullable(v *float64, f func(float64) float64) *float64 {
+	if v == nil {
+		return nil
+	}
+	r := f(*v)
+	return &r
+}
+
+// errorRatio returns errors / total, null when either is missing and 0 without any call.
+func errorRatio(total *float64, errors *float64) *float64 {
+	if total == nil || errors == nil {
+		return nil
+	}
+	ratio := 0.0
+	if *total > 0 {
+		ratio = *errors / *total
+	}
+	return &ratio
+}
+
+// columnKind tells from the values of column col whether it holds numbers: numeric when
+// at least one value is a number, all numeric when every value that is not null is one.
+// A column of nulls only is numeric but not all numeric.
+func columnKind(logs []map[string]string, col string) (numeric bool, allNumeric bool) {
+	allNumeric = true
+	values := 0
+	for _, alog := range logs {
+		v := strings.ToLower(strings.TrimSpace(alog[col]))
+		if v == "" || v == "null" || v == "nan" {
+			continue
+		}
+		values++
+		if _, err := strconv.ParseFloat(v, 64); err == nil {
+			numeric = true
+		} else {
+			allNumeric = false
+		}
+	}
+	if values == 0 {
+		return true, false
+	}
+	return numeric, allNumeric
+}
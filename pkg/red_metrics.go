@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	// redMetricsLimit bounds the number of rows returned by the RED metrics query.
+	redMetricsLimit = 100000
+	// redMetricsPoints is the number of points per series used when no step is set.
+	redMetricsPoints = 300
+)
+
+// redPercentiles are the latency percentiles returned for every series.
+var redPercentiles = []float64{0.5, 0.95, 0.99}
+
+// QueryRedMetrics returns rate, error ratio and latency percentile series
+// for every service and operation of the trace logstore.
+func (ds *SlsDatasource) QueryRedMetrics(client *sls.Client, logSource *LogSource, queryInfo *QueryInfo,
+	from int64, to int64, frames *data.Frames) error {
+	step, err := redMetricsStep(queryInfo.Step, from, to)
+	if err != nil {
+		return err
+	}
+	schema := &logSource.TraceSchema
+	query := buildRedMetricsQuery(queryInfo, schema, step)
+	log.DefaultLogger.Info("QueryRedMetrics", "query", query)
+	getLogsResp, err := client.GetLogs(logSource.Project, logSource.LogStore, "",
+		from, to, query, 0, 0, true)
+	if err != nil {
+		log.DefaultLogger.Error("QueryRedMetrics", "query", query, "error", err)
+		return err
+	}
+	ds.BuildRedMetrics(getLogsResp.Logs, schema, step, frames)
+	return nil
+}
+
+// redMetricsStep returns the bucket size in seconds, either parsed from step
+// or chosen to give about redMetricsPoints points over the time range.
+func redMetricsStep(step string, from int64, to int64) (int64, error) {
+	if step != "" {
+		d, err := time.ParseDuration(step)
+		if err != nil {
+			return 0, fmt.Errorf("invalid step: %s", err.Error())
+		}
+		if d < time.Second {
+			return 0, fmt.Errorf("invalid step: %s is less than 1s", step)
+		}
+		return int64(d / time.Second), nil
+	}
+	seconds := (to - from) / redMetricsPoints
+	if seconds < 60 {
+		return 60, nil
+	}
+	return seconds - seconds%60, nil
+}
+
+func buildRedMetricsQuery(queryInfo *QueryInfo, schema *TraceSchema, step int64) string {
+	var conditions []string
+	if queryInfo.Service != "" {
+		conditions = append(conditions, quoteSQLIdent(schema.Service)+" = "+quoteSQLValue(queryInfo.Service))
+	}
+	if queryInfo.Operation != "" {
+		conditions = append(conditions, quoteSQLIdent(schema.Operation)+" = "+quoteSQLValue(queryInfo.Operation))
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = " where " + strings.Join(conditions, " and ")
+	}
+	// span start in seconds
+	start := fmt.Sprintf("(cast(%s as bigint) / %d)", quoteSQLIdent(schema.Start), int64(1e9/timeUnitNanos[schema.TimeUnit]))
+	var percentiles []string
+	for _, p := range redPercentiles {
+		percentiles = append(percentiles, fmt.Sprintf("approx_percentile(%s, %g) as %s",
+			schema.DurationExpr(), p, percentileColumn(p)))
+	}
+	return fmt.Sprintf("* | select %[1]s - %[1]s %% %[2]d as t, %[3]s as service, %[4]s as operation, "+
+		"count(1) as total, count_if(%[5]s) as errors, %[6]s from log%[7]s "+
+		"group by t, service, operation order by t limit %[8]d",
+		start, step, quoteSQLIdent(schema.Service), quoteSQLIdent(schema.Operation), schema.ErrorExpr(""),
+		strings.Join(percentiles, ", "), where, redMetricsLimit)
+}
+
+// percentileColumn names the column of percentile p, e.g. p95 for 0.95.
+func percentileColumn(p float64) string {
+	return "p" + strconv.FormatFloat(p*100, 'f', -1, 64)
+}
+
+// redSeries holds the points of one service and operation.
+type redSeries struct {
+	service     string
+	operation   string
+	times       []time.Time
+	rate        []*float64
+	errorRatio  []*float64
+	percentiles [][]*float64
+}
+
+// BuildRedMetrics
+// t,service,operation,total,errors,p50,p95,p99 -> rate, error_ratio and latency series labelled by service and operation
+func (ds *SlsDatasource) BuildRedMetrics(logs []map[string]string, schema *TraceSchema, step int64, frames *data.Frames) {
+	seriesMap := make(map[string]*redSeries)
+	var keys []string
+	for _, alog := range logs {
+		t, err := strconv.ParseInt(alog["t"], 10, 64)
+		if err != nil {
+			log.DefaultLogger.Error("BuildRedMetrics", "ParseInt", err, "value", alog["t"])
+			continue
+		}
+		key := alog["service"] + "\x00" + alog["operation"]
+		series, ok := seriesMap[key]
+		if !ok {
+			series = &redSeries{
+				service:     alog["service"],
+				operation:   alog["operation"],
+				percentiles: make([][]*float64, len(redPercentiles)),
+			}
+			seriesMap[key] = series
+			keys = append(keys, key)
+		}
+		total := parseNullableFloat("BuildRedMetrics", alog["total"])
+		series.times = append(series.times, time.Unix(t, 0))
+		series.rate = append(series.rate, mapNullable(total, func(v float64) float64 { return v / float64(step) }))
+		series.errorRatio = append(series.errorRatio, errorRatio(total, parseNullableFloat("BuildRedMetrics", alog["errors"])))
+		for i, p := range redPercentiles {
+			v := parseNullableFloat("BuildRedMetrics", alog[percentileColumn(p)])
+			series.percentiles[i] = append(series.percentiles[i], mapNullable(v, schema.ToMillis))
+		}
+	}
+	sort.Strings(keys)
+
+	newFrame := func(series *redSeries, name string, values []*float64, unit string) *data.Frame {
+		labels := data.Labels{"service": series.service, "operation": series.operation}
+		field := data.NewField(name, labels, values)
+		field.Config = &data.FieldConfig{Unit: unit}
+		return data.NewFrame(name, data.NewField("time", nil, series.times), field)
+	}
+	for _, key := range keys {
+		series := seriesMap[key]
+		*frames = append(*frames, newFrame(series, "rate", series.rate, "reqps"))
+		*frames = append(*frames, newFrame(series, "error_ratio", series.errorRatio, "percentunit"))
+		for i, p := range redPercentiles {
+			*frames = append(*frames, newFrame(series, percentileColumn(p), series.percentiles[i], "ms"))
+		}
+	}
+}
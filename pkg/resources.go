@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+)
+
+const (
+	// resourceCacheTTL is how long listed projects and logstores are reused.
+	resourceCacheTTL = time.Minute
+	// listPageSize is the page size used to read the SLS lists.
+	listPageSize = 500
+	// defaultListSize and maxListSize bound the items of one resource response.
+	defaultListSize = 100
+	maxListSize     = 1000
+)
+
+// ttlCache keeps values for a fixed time.
+type ttlCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+func newTTLCache(ttl time.Duration) *ttlCache {
+	return &ttlCache{ttl: ttl, entries: make(map[string]cacheEntry)}
+}
+
+// Get returns the value of key, computing and storing it with load when missing or expired.
+// Errors are not cached.
+func (c *ttlCache) Get(key string, load func() (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && time.Now().Before(e.expires) {
+		c.mu.Unlock()
+		return e.value, nil
+	}
+	c.mu.Unlock()
+	value, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cacheEntry{value: value, expires: now.Add(c.ttl)}
+	return value, nil
+}
+
+// listResponse is a page of names.
+type listResponse struct {
+	Items []string `json:"items"`
+	Total int      `json:"total"`
+}
+
+// newResourceHandler routes the resource calls of the datasource.
+func (ds *SlsDatasource) newResourceHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/projects", ds.handleProjects)
+	mux.HandleFunc("/logstores", ds.handleLogStores)
+	mux.HandleFunc("/index", ds.handleIndex)
+	mux.HandleFunc("/tag-keys", ds.handleTagKeys)
+	mux.HandleFunc("/tag-values", ds.handleTagValues)
+	mux.HandleFunc("/distribution", ds.handleDistribution)
+	mux.HandleFunc("/validate", ds.handleValidate)
+	return mux
+}
+
+// handleProjects lists the projects the datasource may query.
+// Parameters: name (substring filter), offset and size.
+func (ds *SlsDatasource) handleProjects(w http.ResponseWriter, r *http.Request) {
+	logSource, ok := resourceSettings(w, r)
+	if !ok {
+		return
+	}
+	names, err := ds.resourceCache.Get(logSource.UID+"/projects", func() (interface{}, error) {
+		return listProjects(logSource)
+	})
+	if err != nil {
+		writeResourceError(w, http.StatusBadGateway, err)
+		return
+	}
+	var allowed []string
+	for _, name := range names.([]string) {
+		if logSource.projectAllowed(name) {
+			allowed = append(allowed, name)
+		}
+	}
+	writeList(w, r, allowed)
+}
+
+// handleLogStores lists the logstores of a project the datasource may query.
+// Parameters: project (the datasource project by default), name (substring filter), offset and size.
+func (ds *SlsDatasource) handleLogStores(w http.ResponseWriter, r *http.Request) {
+	logSource, ok := resourceSettings(w, r)
+	if !ok {
+		return
+	}
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		project = logSource.Project
+	}
+	if !logSource.projectAllowed(project) {
+		writeResourceError(w, http.StatusForbidden, fmt.Errorf("project %s is not allowed", project))
+		return
+	}
+	names, err := ds.resourceCache.Get(logSource.UID+"/logstores/"+project, func() (interface{}, error) {
+		return listLogStores(logSource, project)
+	})
+	if err != nil {
+		writeResourceError(w, http.StatusBadGateway, err)
+		return
+	}
+	var allowed []string
+	for _, name := range names.([]string) {
+		if logSource.logStoreAllowed(project, name) {
+			allowed = append(allowed, name)
+		}
+	}
+	writeList(w, r, allowed)
+}
+
+// resourceSettings loads the settings of the datasource called, writing the error when it fails.
+func resourceSettings(w http.ResponseWriter, r *http.Request) (*LogSource, bool) {
+	if r.Method != http.MethodGet {
+		writeResourceError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return nil, false
+	}
+	logSource, err := LoadSettings(httpadapter.PluginConfigFromContext(r.Context()))
+	if err != nil {
+		writeResourceError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return logSource, true
+}
+
+// listProjects returns the names of every project of the endpoint, sorted.
+func listProjects(logSource *LogSource) ([]string, error) {
+	client := NewClient(logSource)
+	var names []string
+	for offset := 0; ; {
+		projects, count, total, err := client.ListProjectV2(offset, listPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range projects {
+			names = append(names, p.Name)
+		}
+		offset += count
+		if count == 0 || offset >= total {
+			break
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// listLogStores returns the names of every logstore of project, sorted.
+func listLogStores(logSource *LogSource, project string) ([]string, error) {
+	client := NewClient(logSource)
+	var names []string
+	for offset := 0; ; offset += listPageSize {
+		logstores, err := client.ListLogStoreV2(project, offset, listPageSize, "")
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, logstores...)
+		if len(logstores) < listPageSize {
+			break
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// writeList writes the page of names selected by the name, offset and size parameters.
+func writeList(w http.ResponseWriter, r *http.Request, names []string) {
+	params := r.URL.Query()
+	filter := strings.ToLower(params.Get("name"))
+	var matched []string
+	for _, name := range names {
+		if strings.Contains(strings.ToLower(name), filter) {
+			matched = append(matched, name)
+		}
+	}
+	offset, _ := strconv.Atoi(params.Get("offset"))
+	if offset < 0 || offset > len(matched) {
+		offset = len(matched)
+	}
+	size, _ := strconv.Atoi(params.Get("size"))
+	if size <= 0 {
+		size = defaultListSize
+	} else if size > maxListSize {
+		size = maxListSize
+	}
+	end := offset + size
+	if end > len(matched) {
+		end = len(matched)
+	}
+	writeJSON(w, &listResponse{Items: append([]string{}, matched[offset:end]...), Total: len(matched)})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.DefaultLogger.Error("writeJSON", "error", err)
+	}
+}
+
+func writeResourceError(w http.ResponseWriter, status int, err error) {
+	log.DefaultLogger.Error("CallResource", "status", status, "error", err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
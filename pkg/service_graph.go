@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// serviceGraphLimit bounds the number of services and service pairs returned.
+const serviceGraphLimit = 10000
+
+// QueryServiceGraph aggregates the spans of the time range into a service
+// dependency graph made of a nodes frame and an edges frame.
+func (ds *SlsDatasource) QueryServiceGraph(client *sls.Client, logSource *LogSource, from int64, to int64, frames *data.Frames) error {
+	schema := &logSource.TraceSchema
+	nodesQuery, edgesQuery := buildServiceGraphQueries(schema)
+
+	nodesResp, err := client.GetLogs(logSource.Project, logSource.LogStore, "",
+		from, to, nodesQuery, 0, 0, true)
+	if err != nil {
+		log.DefaultLogger.Error("QueryServiceGraph", "query", nodesQuery, "error", err)
+		return err
+	}
+	edgesResp, err := client.GetLogs(logSource.Project, logSource.LogStore, "",
+		from, to, edgesQuery, 0, 0, true)
+	if err != nil {
+		log.DefaultLogger.Error("QueryServiceGraph", "query", edgesQuery, "error", err)
+		return err
+	}
+	ds.BuildServiceGraph(nodesResp.Logs, edgesResp.Logs, schema, float64(to-from), frames)
+	return nil
+}
+
+// buildServiceGraphQueries returns the per service statistics query and the
+// parent/child service pair query, joining each span to its parent span.
+func buildServiceGraphQueries(schema *TraceSchema) (string, string) {
+	service := quoteSQLIdent(schema.Service)
+	traceID := quoteSQLIdent(schema.TraceID)
+	spanID := quoteSQLIdent(schema.SpanID)
+	parentSpanID := quoteSQLIdent(schema.ParentSpanID)
+	nodes := fmt.Sprintf("* | select %s as service, count(1) as total, count_if(%s) as errors, "+
+		"approx_percentile(%s, 0.95) as p95 from log group by service limit %d",
+		service, schema.ErrorExpr(""), schema.DurationExpr(), serviceGraphLimit)
+	edges := fmt.Sprintf("* | select p.%[1]s as source, c.%[1]s as target, count(1) as calls, "+
+		"count_if(%[5]s) as errors from log c join log p on c.%[2]s = p.%[2]s and c.%[3]s = p.%[4]s "+
+		"where c.%[1]s <> p.%[1]s group by source, target limit %[6]d",
+		service, traceID, parentSpanID, spanID, schema.ErrorExpr("c."), serviceGraphLimit)
+	return nodes, edges
+}
+
+// BuildServiceGraph
+// nodes: service,total,errors,p95  edges: source,target,calls,errors
+func (ds *SlsDatasource) BuildServiceGraph(nodeLogs []map[string]string, edgeLogs []map[string]string,
+	schema *TraceSchema, seconds float64, frames *data.Frames) {
+	if seconds <= 0 {
+		seconds = 1
+	}
+	sort.Slice(nodeLogs, func(i, j int) bool {
+		return nodeLogs[i]["service"] < nodeLogs[j]["service"]
+	})
+	sort.Slice(edgeLogs, func(i, j int) bool {
+		if edgeLogs[i]["source"] != edgeLogs[j]["source"] {
+			return edgeLogs[i]["source"] < edgeLogs[j]["source"]
+		}
+		return edgeLogs[i]["target"] < edgeLogs[j]["target"]
+	})
+
+	nodes := data.NewFrame("nodes")
+	nodes.Meta = &data.FrameMeta{
+		PreferredVisualization: data.VisTypeNodeGraph,
+	}
+	id := make([]string, 0)
+	rate := make([]*float64, 0)
+	p95 := make([]*float64, 0)
+	errorRate := make([]*float64, 0)
+	successRate := make([]*float64, 0)
+	for _, alog := range nodeLogs {
+		total := parseNullableFloat("BuildServiceGraph", alog["total"])
+		ratio := errorRatio(total, parseNullableFloat("BuildServiceGraph", alog["errors"]))
+		id = append(id, alog["service"])
+		rate = append(rate, mapNullable(total, func(v float64) float64 { return v / seconds }))
+		p95 = append(p95, mapNullable(parseNullableFloat("BuildServiceGraph", alog["p95"]), schema.ToMillis))
+		errorRate = append(errorRate, ratio)
+		successRate = append(successRate, mapNullable(ratio, func(v float64) float64 { return 1 - v }))
+	}
+	rateField := data.NewField("mainStat", nil, rate)
+	rateField.Config = &data.FieldConfig{DisplayName: "Requests", Unit: "reqps"}
+	p95Field := data.NewField("secondaryStat", nil, p95)
+	p95Field.Config = &data.FieldConfig{DisplayName: "p95 latency", Unit: "ms"}
+	successField := data.NewField("arc__success", nil, successRate)
+	successField.Config = &data.FieldConfig{DisplayName: "Success", Color: map[string]interface{}{"mode": "fixed", "fixedColor": "green"}}
+	errorField := data.NewField("arc__errors", nil, errorRate)
+	errorField.Config = &data.FieldConfig{DisplayName: "Errors", Color: map[string]interface{}{"mode": "fixed", "fixedColor": "red"}}
+	errorRateField := data.NewField("detail__errorRate", nil, errorRate)
+	errorRateField.Config = &data.FieldConfig{DisplayName: "Error rate", Unit: "percentunit"}
+	nodes.Fields = append(nodes.Fields,
+		data.NewField("id", nil, id),
+		data.NewField("title", nil, id),
+		rateField,
+		p95Field,
+		successField,
+		errorField,
+		errorRateField,
+	)
+
+	edges := data.NewFrame("edges")
+	edges.Meta = &data.FrameMeta{
+		PreferredVisualization: data.VisTypeNodeGraph,
+	}
+	edgeID := make([]string, 0)
+	source := make([]string, 0)
+	target := make([]string, 0)
+	calls := make([]*float64, 0)
+	edgeErrors := make([]*float64, 0)
+	for _, alog := range edgeLogs {
+		edgeID = append(edgeID, alog["source"]+"->"+alog["target"])
+		source = append(source, alog["source"])
+		target = append(target, alog["target"])
+		calls = append(calls, parseNullableFloat("BuildServiceGraph", alog["calls"]))
+		edgeErrors = append(edgeErrors, parseNullableFloat("BuildServiceGraph", alog["errors"]))
+	}
+	callsField := data.NewField("mainStat", nil, calls)
+	callsField.Config = &data.FieldConfig{DisplayName: "Calls"}
+	edgeErrorsField := data.NewField("secondaryStat", nil, edgeErrors)
+	edgeErrorsField.Config = &data.FieldConfig{DisplayName: "Errors"}
+	edges.Fields = append(edges.Fields,
+		data.NewField("id", nil, edgeID),
+		data.NewField("source", nil, source),
+		data.NewField("target", nil, target),
+		callsField,
+		edgeErrorsField,
+	)
+	*frames = append(*frames, nodes, edges)
+}
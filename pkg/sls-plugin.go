@@ -13,13 +13,18 @@ import (
 	"time"
 
 	sls "github.com/aliyun/aliyun-log-go-sdk"
+	"github.com/oschwald/maxminddb-golang"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
 )
 
+// legendRe matches the {{name}} placeholders of a legend template.
+var legendRe = regexp.MustCompile(`\{\{\s*[^{}]+?\s*\}\}`)
+
 // Make sure SampleDatasource implements required interfaces. This is important to do
 // since otherwise we will only get a not implemented error response from plugin in
 // runtime. In this example datasource instance implements backend.QueryDataHandler,
@@ -33,23 +38,48 @@ var (
 	_ backend.QueryDataHandler      = (*SlsDatasource)(nil)
 	_ backend.CheckHealthHandler    = (*SlsDatasource)(nil)
 	_ backend.StreamHandler         = (*SlsDatasource)(nil)
+	_ backend.CallResourceHandler   = (*SlsDatasource)(nil)
 	_ instancemgmt.InstanceDisposer = (*SlsDatasource)(nil)
 )
 
 // NewSampleDatasource creates a new datasource instance.
 func NewSLSDatasource(_ backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
-	return &SlsDatasource{}, nil
+	ds := &SlsDatasource{
+		resourceCache: newTTLCache(resourceCacheTTL),
+		indexCache:    newTTLCache(indexCacheTTL),
+	}
+	ds.CallResourceHandler = httpadapter.New(ds.newResourceHandler())
+	return ds, nil
 }
 
 // SampleDatasource is an example datasource which can respond to data queries, reports
 // its health and has streaming skills.
-type SlsDatasource struct{}
+type SlsDatasource struct {
+	backend.CallResourceHandler
+
+	geoIPMu   sync.Mutex
+	geoIP     *maxminddb.Reader
+	geoIPPath string
+
+	streamsMu sync.Mutex
+	streams   map[string]bool
+	registry  map[string]*registeredStream
+
+	resourceCache *ttlCache
+	indexCache    *ttlCache
+}
 
 // Dispose here tells plugin SDK that plugin wants to clean up resources when a new instance
 // created. As soon as datasource settings change detected by SDK old datasource instance will
 // be disposed and a new one will be created using NewSampleDatasource factory function.
 func (ds *SlsDatasource) Dispose() {
 	// Clean up datasource instance resources.
+	ds.geoIPMu.Lock()
+	defer ds.geoIPMu.Unlock()
+	if ds.geoIP != nil {
+		ds.geoIP.Close()
+		ds.geoIP = nil
+	}
 }
 
 // QueryData handles multiple queries and returns multiple responses.
@@ -64,12 +94,7 @@ func (ds *SlsDatasource) QueryData(ctx context.Context, req *backend.QueryDataRe
 		return
 	}
 
-	client := &sls.Client{
-		Endpoint:        config.Endpoint,
-		AccessKeyID:     config.AccessKeyId,
-		AccessKeySecret: config.AccessKeySecret,
-		UserAgent:       "grafana-go",
-	}
+	client := NewClient(config)
 
 	// create response struct
 	response := backend.NewQueryDataResponse()
@@ -109,40 +134,32 @@ func (ds *SlsDatasource) QueryData(ctx context.Context, req *backend.QueryDataRe
 	return response, nil
 }
 
+// NewClient returns an SLS client for the datasource.
+func NewClient(logSource *LogSource) *sls.Client {
+	return &sls.Client{
+		Endpoint:        logSource.Endpoint,
+		AccessKeyID:     logSource.AccessKeyId,
+		AccessKeySecret: logSource.AccessKeySecret,
+		UserAgent:       "grafana-go",
+	}
+}
+
 // CheckHealth handles health checks sent from Grafana to the plugin.
 // The main use case for these health checks is the test button on the
 // datasource configuration page which allows users to verify that
 // a datasource is working as expected.
-func (ds *SlsDatasource) CheckHealth(_ context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
+func (ds *SlsDatasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
 	log.DefaultLogger.Info("CheckHealth called", "request", req)
 
 	config, err := LoadSettings(req.PluginContext)
 	if err != nil {
 		return nil, err
 	}
-
-	client := &sls.Client{
-		Endpoint:        config.Endpoint,
-		AccessKeyID:     config.AccessKeyId,
-		AccessKeySecret: config.AccessKeySecret,
-		UserAgent:       "grafana-go",
-	}
-
-	var status = backend.HealthStatusOk
-	var message = "Data source is working"
-
-	from := time.Now().Unix()
-	_, err = client.GetLogs(config.Project, config.LogStore, "",
-		from-60, from, "* | select count(*)", 0, 0, true)
-	if err != nil {
-		status = backend.HealthStatusError
-		message = err.Error()
+	res := ds.checkHealth(ctx, config)
+	if res.Status != backend.HealthStatusOk {
+		log.DefaultLogger.Warn("CheckHealth", "message", res.Message, "details", string(res.JSONDetails))
 	}
-
-	return &backend.CheckHealthResult{
-		Status:  status,
-		Message: message,
-	}, nil
+	return res, nil
 }
 
 // SubscribeStream is called when a client wants to connect to a stream. This callback
@@ -150,10 +167,20 @@ func (ds *SlsDatasource) CheckHealth(_ context.Context, req *backend.CheckHealth
 func (ds *SlsDatasource) SubscribeStream(_ context.Context, req *backend.SubscribeStreamRequest) (*backend.SubscribeStreamResponse, error) {
 	log.DefaultLogger.Info("SubscribeStream called", "request", req)
 
-	status := backend.SubscribeStreamStatusPermissionDenied
-	if req.Path == "stream" {
-		// Allow subscribing only on expected path.
-		status = backend.SubscribeStreamStatusOK
+	config, err := LoadSettings(req.PluginContext)
+	if err != nil {
+		return nil, err
+	}
+	path, _, status := ds.lookupStream(config, req.Path)
+	if status == backend.SubscribeStreamStatusOK {
+		if !userAllowed(req.PluginContext.User, config) {
+			status = backend.SubscribeStreamStatusPermissionDenied
+		} else if path.Kind == streamKindQuery && ds.streamFull(req.Path, config.MaxStreams) {
+			status = backend.SubscribeStreamStatusPermissionDenied
+		}
+	}
+	if status != backend.SubscribeStreamStatusOK {
+		log.DefaultLogger.Warn("SubscribeStream refused", "path", req.Path, "status", status)
 	}
 	return &backend.SubscribeStreamResponse{
 		Status: status,
@@ -165,66 +192,46 @@ func (ds *SlsDatasource) SubscribeStream(_ context.Context, req *backend.Subscri
 func (ds *SlsDatasource) RunStream(ctx context.Context, req *backend.RunStreamRequest, sender *backend.StreamSender) error {
 	log.DefaultLogger.Info("RunStream called", "request", req)
 
-	// Create the same data frame as for query data.
-	frame := data.NewFrame("response")
-
-	// Add fields (matching the same schema used in QueryData).
-	frame.Fields = append(frame.Fields,
-		data.NewField("time", nil, make([]time.Time, 1)),
-		data.NewField("values", nil, make([]int64, 1)),
-	)
-
-	counter := 0
-
-	// Stream data frames periodically till stream closed by Grafana.
-	for {
-		select {
-		case <-ctx.Done():
-			log.DefaultLogger.Info("Context done, finish streaming", "path", req.Path)
-			return nil
-		case <-time.After(time.Second):
-			// Send new data periodically.
-			frame.Fields[0].Set(0, time.Now())
-			frame.Fields[1].Set(0, int64(10*(counter%2+1)))
-
-			counter++
-
-			err := sender.SendFrame(frame, data.IncludeAll)
-			if err != nil {
-				log.DefaultLogger.Error("Error sending frame", "error", err)
-				continue
-			}
+	config, err := LoadSettings(req.PluginContext)
+	if err != nil {
+		return err
+	}
+	path, params, status := ds.lookupStream(config, req.Path)
+	if status != backend.SubscribeStreamStatusOK {
+		return fmt.Errorf("stream %s is not available", req.Path)
+	}
+	if path.Kind == streamKindQuery {
+		stream, err := parseQueryStream(params)
+		if err != nil {
+			return err
 		}
+		return ds.StreamQuery(ctx, config, req.Path, stream, sender)
 	}
+	tail := &tailParams{}
+	if err = json.Unmarshal(params, tail); err != nil {
+		return err
+	}
+	return ds.TailLogs(ctx, NewClient(config), config, path, tail, sender)
 }
 
 // PublishStream is called when a client sends a message to the stream.
 func (ds *SlsDatasource) PublishStream(_ context.Context, req *backend.PublishStreamRequest) (*backend.PublishStreamResponse, error) {
 	log.DefaultLogger.Info("PublishStream called", "request", req)
 
-	// Do not allow publishing at all.
+	// Streams are only written by the plugin, clients may not publish to them.
+	status := backend.PublishStreamStatusPermissionDenied
+	config, err := LoadSettings(req.PluginContext)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, s := ds.lookupStream(config, req.Path); s == backend.SubscribeStreamStatusNotFound {
+		status = backend.PublishStreamStatusNotFound
+	}
 	return &backend.PublishStreamResponse{
-		Status: backend.PublishStreamStatusPermissionDenied,
+		Status: status,
 	}, nil
 }
 
-func (ds *SlsDatasource) SortLogs(logs []map[string]string, col string) {
-	sort.Slice(logs, func(i, j int) bool {
-		f1, err := strconv.ParseFloat(logs[i][col], 64)
-		if err != nil {
-			backend.Logger.Error("SortLogs1", "error ", err)
-		}
-		f2, err := strconv.ParseFloat(logs[j][col], 64)
-		if err != nil {
-			backend.Logger.Error("SortLogs2", "error ", err)
-		}
-		if f1 < f2 {
-			return true
-		}
-		return false
-	})
-}
-
 func (ds *SlsDatasource) QueryLogs(ch chan Result, query backend.DataQuery, client *sls.Client, logSource *LogSource) {
 	response := backend.DataResponse{}
 	refId := query.RefID
@@ -256,17 +263,100 @@ func (ds *SlsDatasource) QueryLogs(ch chan Result, query backend.DataQuery, clie
 		}
 		return
 	}
+	logSource, err = logSource.ForQuery(queryInfo)
+	if err != nil {
+		response.Error = err
+		ch <- Result{
+			refId:        refId,
+			dataResponse: response,
+		}
+		return
+	}
 	xcol := queryInfo.Xcol
 
 	from := query.TimeRange.From.Unix()
 	to := query.TimeRange.To.Unix()
+	interval := autoInterval(query)
+	queryInfo.Query = expandIntervalVariables(queryInfo.Query, interval)
+	var filterNotices []data.Notice
+	if len(queryInfo.AdhocFilters) > 0 {
+		queryInfo.Query, filterNotices = applyAdhocFilters(queryInfo.Query, queryInfo.AdhocFilters, ds.fieldTypes(logSource))
+	}
 
 	log.DefaultLogger.Info("QueryLogs", "queryInfo", queryInfo)
 
+	if queryInfo.QueryType != "" {
+		var frames data.Frames
+		switch queryInfo.QueryType {
+		case QueryTypeTraceID:
+			log.DefaultLogger.Info("trace_id")
+			err = ds.QueryTraceByID(client, logSource, queryInfo, from, to, &frames)
+		case QueryTypeTraceSearch:
+			log.DefaultLogger.Info("trace_search")
+			err = ds.QueryTraceSearch(client, logSource, queryInfo, from, to, &frames)
+		case QueryTypeServiceGraph:
+			log.DefaultLogger.Info("service_graph")
+			err = ds.QueryServiceGraph(client, logSource, from, to, &frames)
+		case QueryTypeRedMetrics:
+			log.DefaultLogger.Info("red_metrics")
+			err = ds.QueryRedMetrics(client, logSource, queryInfo, from, to, &frames)
+		case QueryTypeGeo:
+			log.DefaultLogger.Info("geo")
+			err = ds.QueryGeo(client, logSource, queryInfo, from, to, &frames)
+		case QueryTypeHeatmap:
+			log.DefaultLogger.Info("heatmap")
+			err = ds.QueryHeatmap(client, logSource, queryInfo, from, to, &frames)
+		case QueryTypeHistogram:
+			log.DefaultLogger.Info("histogram")
+			err = ds.QueryHistogram(client, logSource, queryInfo, from, to, &frames)
+		case QueryTypeVariable:
+			log.DefaultLogger.Info("variable")
+			err = ds.QueryVariable(client, logSource, queryInfo, from, to, &frames)
+		default:
+			err = fmt.Errorf("unsupported query type: %s", queryInfo.QueryType)
+		}
+		appendNotices(frames, filterNotices...)
+		response.Frames = frames
+		response.Error = err
+		ch <- Result{
+			refId:        refId,
+			dataResponse: response,
+		}
+		return
+	}
+
+	parser, err := NewTimeParser(logSource.Timezone, queryInfo.TimeFormat)
+	if err != nil {
+		response.Error = err
+		ch <- Result{
+			refId:        refId,
+			dataResponse: response,
+		}
+		return
+	}
+
+	plan, err := newChunkPlan(queryInfo.Chunk, queryInfo.Query, interval, parser.Location, from)
+	if err != nil {
+		response.Error = err
+		ch <- Result{
+			refId:        refId,
+			dataResponse: response,
+		}
+		return
+	}
+
+	shifts, err := parseTimeShifts(queryInfo.TimeShifts)
+	if err != nil {
+		response.Error = err
+		ch <- Result{
+			refId:        refId,
+			dataResponse: response,
+		}
+		return
+	}
+
 	var ycols []string
-	offset := (queryInfo.CurrentPage - 1) * queryInfo.LogsPerPage
-	getLogsResp, err := client.GetLogs(logSource.Project, logSource.LogStore, "",
-		from, to, queryInfo.Query, queryInfo.LogsPerPage, offset, true)
+	getLogsResp, rangeNotices, err := ds.GetLogsRange(client, logSource, queryInfo, from, to, plan)
 	if err != nil {
 		log.DefaultLogger.Error("GetLogs ", "query : ", queryInfo.Query, "error ", err)
 		response.Error = err
@@ -276,6 +366,7 @@ func (ds *SlsDatasource) QueryLogs(ch chan Result, query backend.DataQuery, clie
 		}
 		return
 	}
+	rangeNotices = append(filterNotices, rangeNotices...)
 	logs := getLogsResp.Logs
 	c := &Contents{}
 	err = json.Unmarshal([]byte(getLogsResp.Contents), &c)
@@ -303,7 +394,7 @@ func (ds *SlsDatasource) QueryLogs(ch chan Result, query backend.DataQuery, clie
 
 	if xcol == "trace" {
 		log.DefaultLogger.Info("BuildTrace")
-		ds.BuildTrace(logs, &frames)
+		ds.BuildTrace(logs, &logSource.TraceSchema, &frames)
 		response.Frames = frames
 		ch <- Result{
 			refId:        refId,
@@ -313,7 +404,15 @@ func (ds *SlsDatasource) QueryLogs(ch chan Result, query backend.DataQuery, clie
 	}
 	if !strings.Contains(queryInfo.Query, "|") {
 		log.DefaultLogger.Info("BuildLogs")
-		ds.BuildLogs(logs, ycols, &frames)
+		ds.BuildLogs(logs, ycols, logSource, from, to, &frames)
+		appendNotices(frames, rangeNotices...)
+		if queryInfo.QueryMode == QueryModeLive {
+			if channel, err := ds.tailChannel(logSource, queryInfo); err != nil {
+				appendNotices(frames, data.Notice{Severity: data.NoticeSeverityError, Text: err.Error()})
+			} else {
+				frames[0].Meta.Channel = channel
+			}
+		}
 		response.Frames = frames
 		ch <- Result{
 			refId:        refId,
@@ -322,24 +421,47 @@ func (ds *SlsDatasource) QueryLogs(ch chan Result, query backend.DataQuery, clie
 		return
 	}
 
-	if isFlowGraph {
-		log.DefaultLogger.Info("flow_graph")
-		ds.BuildFlowGraph(logs, xcol, ycols, &frames)
-	} else if xcol == "bar" {
+	if xcol == "bar" {
 		log.DefaultLogger.Info("bar")
-		ds.BuildBarGraph(logs, ycols, &frames)
+		if !isFlowGraph && len(ycols) > 1 {
+			ycols = []string{ycols[0], strings.Join(ycols[1:], ",")}
+		}
+		ds.BuildBarGraph(logs, ycols, keys, queryInfo.BarMode, queryInfo.NullMode, &frames)
+	} else if isFlowGraph {
+		log.DefaultLogger.Info("flow_graph")
+		ds.BuildFlowGraph(logs, xcol, ycols, queryInfo.Legend, parser, queryInfo.NullMode, &frames)
+		rangeNotices = append(rangeNotices, ds.AppendTimeShifts(client, logSource, queryInfo, from, to, plan, shifts,
+			func(logs []map[string]string, keys []string, frames *data.Frames) {
+				ds.BuildFlowGraph(logs, xcol, ycols, queryInfo.Legend, parser, queryInfo.NullMode, frames)
+			}, &frames)...)
+		downsampleFrames(frames, query.MaxDataPoints, interval, queryInfo.Downsample)
 	} else if xcol == "map" {
 		log.DefaultLogger.Info("map")
-		ds.BuildMapGraph(logs, ycols, &frames)
+		ds.BuildMapGraph(logs, ycols, keys, queryInfo.NullMode, &frames)
 	} else if xcol == "pie" {
 		log.DefaultLogger.Info("pie")
-		ds.BuildPieGraph(logs, ycols, &frames)
+		ds.BuildPieGraph(logs, ycols, queryInfo.NullMode, queryInfo.TopN, queryInfo.PieFormat, &frames)
 	} else if xcol != "" && xcol != "map" && xcol != "pie" && xcol != "bar" && xcol != "table" {
 		log.DefaultLogger.Info("time_graph")
-		ds.BuildTimingGraph(logs, xcol, ycols, keys, &frames)
+		ds.BuildTimingGraph(logs, xcol, ycols, keys, parser, queryInfo.NullMode, &frames)
+		rangeNotices = append(rangeNotices, ds.AppendTimeShifts(client, logSource, queryInfo, from, to, plan, shifts,
+			func(logs []map[string]string, keys []string, frames *data.Frames) {
+				ds.BuildTimingGraph(logs, xcol, ycols, keys, parser, queryInfo.NullMode, frames)
+			}, &frames)...)
+		downsampleFrames(frames, query.MaxDataPoints, interval, queryInfo.Downsample)
 	} else {
 		log.DefaultLogger.Info("table")
-		ds.BuildTable(logs, xcol, ycols, keys, &frames)
+		ds.BuildTable(logs, xcol, ycols, keys, parser, &frames)
+	}
+	appendNotices(frames, parser.Notices()...)
+	appendNotices(frames, rangeNotices...)
+	if queryInfo.Stream && len(frames) > 0 {
+		if channel, err := ds.queryChannel(logSource, query); err == nil {
+			if frames[0].Meta == nil {
+				frames[0].Meta = &data.FrameMeta{}
+			}
+			frames[0].Meta.Channel = channel
+		}
 	}
 	response.Frames = frames
 	ch <- Result{
@@ -348,205 +470,362 @@ func (ds *SlsDatasource) QueryLogs(ch chan Result, query backend.DataQuery, clie
 	}
 }
 
-func (ds *SlsDatasource) BuildFlowGraph(logs []map[string]string, xcol string, ycols []string, frames *data.Frames) {
+// BuildFlowGraph
+// ycols: [label columns, value columns] from ycol "label1,label2#:#value1,value2". One series is built
+// per distinct label values and value column, named by legend or the label values, in order of first
+// appearance. Rows are read once; a missing time/series cell is null unless nullMode says otherwise.
+func (ds *SlsDatasource) BuildFlowGraph(logs []map[string]string, xcol string, ycols []string, legend string, parser *TimeParser, nullMode string, frames *data.Frames) {
 	if len(ycols) < 2 {
 		return
 	}
-	frame := data.NewFrame("")
-	fieldMap := make(map[string]map[string]float64)
-	timeSet := make(map[string]bool)
-	labelSet := make(map[string]bool)
-	var labelArr []string
-	for _, alog := range logs {
-		if !labelSet[alog[ycols[0]]] {
-			labelArr = append(labelArr, alog[ycols[0]])
-		}
-		timeSet[alog[xcol]] = true
-		labelSet[alog[ycols[0]]] = true
-	}
-	var timeArr []string
-	for k := range timeSet {
-		timeArr = append(timeArr, k)
-	}
-	sort.Slice(timeArr, func(i, j int) bool {
-		iValue := toTime(timeArr[i])
-		jValue := toTime(timeArr[j])
-		if iValue.Unix() < jValue.Unix() {
-			return true
-		}
-		return false
-	})
-	fieldSet := make(map[string]bool)
-	for label := range labelSet {
-		fieldMap[label] = make(map[string]float64)
+	labelCols := splitColumns(ycols[0])
+	valueCols := splitColumns(ycols[1])
+	if len(labelCols) == 0 || len(valueCols) == 0 {
+		return
 	}
-	for label := range labelSet {
-		for _, t := range timeArr {
-			fieldMap[label][t] = 0
-		}
+	logs = dropNullRows("BuildFlowGraph", logs, valueCols, nullMode)
+
+	type flowSeries struct {
+		name   string
+		labels data.Labels
+		values map[int]*float64
 	}
+	var seriesArr []*flowSeries
+	seriesMap := make(map[string]*flowSeries)
+	timeIndex := make(map[string]int)
+	var times []time.Time
 	for _, alog := range logs {
-		label := alog[ycols[0]]
-		t := alog[xcol]
-		if !fieldSet[t+label] {
-			fieldSet[t+label] = true
-			floatV, err := strconv.ParseFloat(alog[ycols[1]], 64)
-			if err == nil {
-				fieldMap[label][t] = floatV
-			} else {
-				log.DefaultLogger.Error("BuildFlowGraph", "ParseFloat", err, "value", alog[ycols[1]])
-				fieldMap[label][t] = 0
+		ts := alog[xcol]
+		ti, ok := timeIndex[ts]
+		if !ok {
+			t, parsed := parser.ParseColumn(xcol, ts)
+			if !parsed {
+				timeIndex[ts] = -1
+				continue
 			}
-		}
-	}
-	var frameLen int
-	for _, k := range labelArr {
-		v := fieldMap[k]
-		if len(v) > 0 {
-			if frameLen == 0 {
-				frameLen = len(v)
+			ti = len(times)
+			timeIndex[ts] = ti
+			times = append(times, t)
+		}
+		if ti < 0 {
+			continue
+		}
+		labels := make(data.Labels, len(labelCols))
+		labelValues := make([]string, 0, len(labelCols))
+		for _, col := range labelCols {
+			labels[col] = alog[col]
+			labelValues = append(labelValues, alog[col])
+		}
+		for _, valueCol := range valueCols {
+			key := strings.Join(labelValues, "\x00") + "\x00" + valueCol
+			series, ok := seriesMap[key]
+			if !ok {
+				series = &flowSeries{
+					name:   flowSeriesName(legend, labels, labelValues, valueCol, len(valueCols) > 1),
+					labels: labels,
+					values: make(map[int]*float64),
+				}
+				seriesMap[key] = series
+				seriesArr = append(seriesArr, series)
 			}
-			if len(v) == frameLen {
-				frame.Fields = append(frame.Fields, data.NewField(k, nil, mapToSlice(timeArr, v)))
+			if _, exist := series.values[ti]; !exist {
+				series.values[ti] = nullableValue("BuildFlowGraph", alog[valueCol], nullMode)
 			}
 		}
 	}
 
-	var times []time.Time
-	for _, k := range timeArr {
-		times = append(times, toTime(k))
+	// indexes of times in time order, stable for equal times
+	order := make([]int, len(times))
+	for i := range order {
+		order[i] = i
 	}
-	if len(times) == frameLen {
-		frame.Fields = append([]*data.Field{data.NewField("time", nil, times)}, frame.Fields...)
+	sort.SliceStable(order, func(i, j int) bool {
+		return times[order[i]].Before(times[order[j]])
+	})
+	sortedTimes := make([]time.Time, 0, len(times))
+	for _, ti := range order {
+		sortedTimes = append(sortedTimes, times[ti])
 	}
 
+	frame := data.NewFrame("")
+	frame.Fields = append(frame.Fields, data.NewField("time", nil, sortedTimes))
+	for _, series := range seriesArr {
+		values := make([]*float64, 0, len(order))
+		for _, ti := range order {
+			v, ok := series.values[ti]
+			if !ok {
+				v = nullableValue("BuildFlowGraph", "", nullMode)
+			}
+			values = append(values, v)
+		}
+		field := data.NewField(series.name, series.labels, values)
+		field.Config = &data.FieldConfig{DisplayNameFromDS: series.name}
+		frame.Fields = append(frame.Fields, field)
+	}
 	*frames = append(*frames, frame)
 }
 
-func (ds *SlsDatasource) BuildBarGraph(logs []map[string]string, ycols []string, frames *data.Frames) {
+// flowSeriesName renders legend, replacing {{label}} with label values and {{__field__}} with
+// the value column. Without a legend the label values are joined by spaces, followed by the
+// value column when there are several.
+func flowSeriesName(legend string, labels data.Labels, labelValues []string, valueCol string, multiValue bool) string {
+	if legend == "" {
+		name := strings.Join(labelValues, " ")
+		if multiValue {
+			name = strings.TrimSpace(name + " " + valueCol)
+		}
+		return name
+	}
+	return legendRe.ReplaceAllStringFunc(legend, func(m string) string {
+		key := strings.TrimSpace(m[2 : len(m)-2])
+		if key == "__field__" {
+			return valueCol
+		}
+		return labels[key]
+	})
+}
+
+// splitColumns splits a comma separated column list, trimming spaces and dropping empty names.
+func splitColumns(s string) []string {
+	var cols []string
+	for _, col := range strings.Split(s, ",") {
+		if col = strings.TrimSpace(col); col != "" {
+			cols = append(cols, col)
+		}
+	}
+	return cols
+}
+
+// BuildBarGraph
+// ycols: [category columns, value columns] from ycol "category,value1,value2" or
+// "category1,category2#:#value1,value2". Without ycol the string columns of keys are categories
+// and the numeric ones values. By default several categories are joined into one axis label; in
+// BarModeSeries the first category is the axis and the others split the values into one series
+// each, for grouped or stacked bars. Fields follow the column order.
+func (ds *SlsDatasource) BuildBarGraph(logs []map[string]string, ycols []string, keys []string, mode string, nullMode string, frames *data.Frames) {
+	categories, values := barColumns(logs, ycols, keys)
+	if len(categories) == 0 || len(values) == 0 {
+		return
+	}
+	logs = dropNullRows("BuildBarGraph", logs, values, nullMode)
 	frame := data.NewFrame("response")
-	numMap := make(map[string][]float64)
-	for _, ycol := range ycols[1:] {
-		numMap[ycol] = make([]float64, 0)
+
+	var seriesCols []string
+	axisCols := categories
+	if mode == BarModeSeries && len(categories) > 1 {
+		axisCols, seriesCols = categories[:1], categories[1:]
 	}
-	strKey := ycols[0]
-	var strArr []string
+	axisName := strings.Join(axisCols, " / ")
+
+	type series struct {
+		labels data.Labels
+		name   string
+		values []*float64
+	}
+	var axis []string
+	var seriesList []*series
+	axisIndex := make(map[string]int)
+	seriesIndex := make(map[string]*series)
 	for _, alog := range logs {
-		for k, v := range alog {
-			if numMap[k] != nil {
-				floatV, err := strconv.ParseFloat(v, 64)
-				if err == nil {
-					numMap[k] = append(numMap[k], floatV)
-				} else {
-					log.DefaultLogger.Error("BuildBarGraph", "ParseFloat", err, "value", v)
-					numMap[k] = append(numMap[k], floatV)
-				}
+		axisValues := make([]string, 0, len(axisCols))
+		for _, col := range axisCols {
+			axisValues = append(axisValues, alog[col])
+		}
+		label := strings.Join(axisValues, " / ")
+		row, ok := axisIndex[label]
+		if !ok {
+			row = len(axis)
+			axisIndex[label] = row
+			axis = append(axis, label)
+			for _, s := range seriesList {
+				s.values = append(s.values, nil)
 			}
-			if k == strKey {
-				strArr = append(strArr, v)
+		}
+		labels := data.Labels{}
+		seriesValues := make([]string, 0, len(seriesCols))
+		for _, col := range seriesCols {
+			labels[col] = alog[col]
+			seriesValues = append(seriesValues, alog[col])
+		}
+		for _, valueCol := range values {
+			key := strings.Join(append(seriesValues, valueCol), "\x00")
+			s, ok := seriesIndex[key]
+			if !ok {
+				name := valueCol
+				if len(seriesValues) > 0 {
+					name = flowSeriesName("", labels, seriesValues, valueCol, len(values) > 1)
+				}
+				s = &series{labels: labels, name: name, values: make([]*float64, len(axis))}
+				seriesIndex[key] = s
+				seriesList = append(seriesList, s)
 			}
+			s.values[row] = addNullable(s.values[row], nullableValue("BuildBarGraph", alog[valueCol], nullMode))
 		}
 	}
-	frame.Fields = append(frame.Fields, data.NewField(strKey, nil, strArr))
-	for _, ycol := range ycols[1:] {
-		frame.Fields = append(frame.Fields, data.NewField(ycol, nil, numMap[ycol]))
+	frame.Fields = append(frame.Fields, data.NewField(axisName, nil, axis))
+	for _, s := range seriesList {
+		values := s.values
+		if nullMode == NullModeZero {
+			for i, v := range values {
+				if v == nil {
+					zero := 0.0
+					values[i] = &zero
+				}
+			}
+		}
+		field := data.NewField(s.name, nil, values)
+		if len(seriesCols) > 0 {
+			field.Labels = s.labels
+			field.Config = &data.FieldConfig{DisplayNameFromDS: s.name}
+		}
+		frame.Fields = append(frame.Fields, field)
 	}
 	*frames = append(*frames, frame)
 }
 
-func (ds *SlsDatasource) BuildMapGraph(logs []map[string]string, ycols []string, frames *data.Frames) {
-	frame := data.NewFrame("response")
-	strMap := make(map[string][]string)
+// barColumns returns the category and value columns of a bar graph, taken from
+// ycols or else from keys, where the first column is a category and other numeric columns are values.
+func barColumns(logs []map[string]string, ycols []string, keys []string) ([]string, []string) {
+	if len(ycols) == 2 {
+		return splitColumns(ycols[0]), splitColumns(ycols[1])
+	}
+	var categories, values []string
+	for i, key := range keys {
+		if i == 0 {
+			categories = append(categories, key)
+			continue
+		}
+		column := make([]string, 0, len(logs))
+		for _, alog := range logs {
+			column = append(column, alog[key])
+		}
+		if _, ok := numericValues(column); ok {
+			values = append(values, key)
+		} else {
+			categories = append(categories, key)
+		}
+	}
+	return categories, values
+}
 
-	for _, ycol := range ycols[:len(ycols)-1] {
-		strMap[ycol] = make([]string, 0)
+// BuildMapGraph
+// ycols: location columns followed by one numeric column, keys are used without ycol.
+// Fields follow the column order.
+func (ds *SlsDatasource) BuildMapGraph(logs []map[string]string, ycols []string, keys []string, nullMode string, frames *data.Frames) {
+	ycols = splitColumns(strings.Join(ycols, ","))
+	if len(ycols) == 0 {
+		ycols = keys
+	}
+	if len(ycols) == 0 {
+		return
 	}
 	numKey := ycols[len(ycols)-1]
-	var numArr []float64
-	for _, alog := range logs {
-		for k, v := range alog {
-			if strMap[k] != nil {
-				strMap[k] = append(strMap[k], v)
-			}
-			if k == numKey {
-				floatV, err := strconv.ParseFloat(v, 64)
-				if err == nil {
-					numArr = append(numArr, floatV)
-				} else {
-					log.DefaultLogger.Error("BuildMapGraph", "ParseFloat", err, "value", v)
-					numArr = append(numArr, floatV)
-				}
-			}
+	logs = dropNullRows("BuildMapGraph", logs, []string{numKey}, nullMode)
+	frame := data.NewFrame("response")
+	for _, ycol := range ycols[:len(ycols)-1] {
+		strArr := make([]string, 0, len(logs))
+		for _, alog := range logs {
+			strArr = append(strArr, alog[ycol])
 		}
+		frame.Fields = append(frame.Fields, data.NewField(ycol, nil, strArr))
 	}
-	for k, v := range strMap {
-		frame.Fields = append(frame.Fields, data.NewField(k, nil, v))
+	numArr := make([]*float64, 0, len(logs))
+	for _, alog := range logs {
+		numArr = append(numArr, nullableValue("BuildMapGraph", alog[numKey], nullMode))
 	}
 	frame.Fields = append(frame.Fields, data.NewField(numKey, nil, numArr))
 	*frames = append(*frames, frame)
 }
 
-func (ds *SlsDatasource) BuildPieGraph(logs []map[string]string, ycols []string, frames *data.Frames) {
+// BuildPieGraph
+// ycols: label,value. Values are summed per label, the topN largest labels are kept and the
+// rest is folded into an "Other" slice. The wide format has one field per label, the long
+// format has a label and a value field with one row per label.
+func (ds *SlsDatasource) BuildPieGraph(logs []map[string]string, ycols []string, nullMode string, topN int64, format string, frames *data.Frames) {
 	if len(ycols) < 2 {
 		return
 	}
-	frame := data.NewFrame("response")
-	fieldMap := make(map[string][]float64)
-	var labelArr []string
+	logs = dropNullRows("BuildPieGraph", logs, ycols[1:2], nullMode)
+
+	type slice struct {
+		label string
+		value *float64
+	}
+	var slices []*slice
+	index := make(map[string]*slice)
 	for _, alog := range logs {
-		labelArr = append(labelArr, alog[ycols[0]])
+		label := alog[ycols[0]]
+		s, ok := index[label]
+		if !ok {
+			s = &slice{label: label}
+			index[label] = s
+			slices = append(slices, s)
+		}
+		s.value = addNullable(s.value, nullableValue("BuildPieGraph", alog[ycols[1]], nullMode))
 	}
-	for _, label := range labelArr {
-		exist := false
-		for _, alog := range logs {
-			if alog[ycols[0]] == label {
-				floatV, err := strconv.ParseFloat(alog[ycols[1]], 64)
-				if err == nil {
-					fieldMap[label] = append(fieldMap[label], floatV)
-				} else {
-					log.DefaultLogger.Error("BuildPieGraph", "ParseFloat", err, "value", alog[ycols[1]])
-					fieldMap[label] = append(fieldMap[label], 0)
-				}
-				exist = true
-			}
+	sort.SliceStable(slices, func(i, j int) bool {
+		if slices[j].value == nil {
+			return slices[i].value != nil
 		}
-		if !exist {
-			fieldMap[label] = append(fieldMap[label], 0)
+		return slices[i].value != nil && *slices[i].value > *slices[j].value
+	})
+	if topN > 0 && int64(len(slices)) > topN {
+		other := &slice{label: pieOtherLabel}
+		for _, s := range slices[topN:] {
+			other.value = addNullable(other.value, s.value)
 		}
+		slices = append(slices[:topN], other)
 	}
 
-	for _, v := range labelArr {
-		frame.Fields = append(frame.Fields, data.NewField(v, nil, fieldMap[v]))
+	frame := data.NewFrame("response")
+	if format == PieFormatLong {
+		labels := make([]string, 0, len(slices))
+		values := make([]*float64, 0, len(slices))
+		for _, s := range slices {
+			labels = append(labels, s.label)
+			values = append(values, s.value)
+		}
+		frame.Fields = append(frame.Fields,
+			data.NewField(ycols[0], nil, labels),
+			data.NewField(ycols[1], nil, values),
+		)
+	} else {
+		for _, s := range slices {
+			frame.Fields = append(frame.Fields, data.NewField(s.label, nil, []*float64{s.value}))
+		}
 	}
 	*frames = append(*frames, frame)
 }
 
-func (ds *SlsDatasource) BuildTimingGraph(logs []map[string]string, xcol string, ycols []string, keys []string, frames *data.Frames) {
-	ds.SortLogs(logs, xcol)
+// BuildTimingGraph builds one numeric field per ycol over the xcol times. Columns without
+// any numeric value are kept as string fields.
+func (ds *SlsDatasource) BuildTimingGraph(logs []map[string]string, xcol string, ycols []string, keys []string, parser *TimeParser, nullMode string, frames *data.Frames) {
 	frame := data.NewFrame("")
-	fieldMap := make(map[string][]float64)
-	var times []time.Time
+	fieldMap := make(map[string][]*float64)
+	textMap := make(map[string][]string)
 	if len(ycols) == 1 && ycols[0] == "" && len(keys) > 0 {
 		ycols = keys
 	}
+	var valueCols []string
 	for _, v := range ycols {
-		if v != xcol {
-			fieldMap[v] = make([]float64, 0)
+		if v == xcol {
+			continue
 		}
+		if numeric, _ := columnKind(logs, v); !numeric {
+			textMap[v] = make([]string, 0)
+			continue
+		}
+		fieldMap[v] = make([]*float64, 0)
+		valueCols = append(valueCols, v)
 	}
+	logs = dropNullRows("BuildTimingGraph", logs, valueCols, nullMode)
+	logs, times := parser.SortByTime(logs, xcol)
 	for _, alog := range logs {
 		for k, v := range alog {
 			if fieldMap[k] != nil {
-				floatV, err := strconv.ParseFloat(v, 64)
-				if err == nil {
-					fieldMap[k] = append(fieldMap[k], floatV)
-				} else {
-					log.DefaultLogger.Error("BuildTimingGraph", "ParseFloat", err, "value", v)
-					fieldMap[k] = append(fieldMap[k], 0)
-				}
-			}
-			if xcol != "" && xcol == k {
-				times = append(times, toTime(v))
+				fieldMap[k] = append(fieldMap[k], nullableValue("BuildTimingGraph", v, nullMode))
+			} else if textMap[k] != nil {
+				textMap[k] = append(textMap[k], v)
 			}
 		}
 	}
@@ -556,18 +835,26 @@ func (ds *SlsDatasource) BuildTimingGraph(logs []map[string]string, xcol string,
 			frameLen = len(v)
 		}
 	}
+	for _, v := range textMap {
+		if len(v) > frameLen {
+			frameLen = len(v)
+		}
+	}
 	if len(times) == frameLen {
 		frame.Fields = append(frame.Fields, data.NewField("time", nil, times))
 	}
 	for _, v := range ycols {
 		if field, ok := fieldMap[v]; ok && len(field) == frameLen {
 			frame.Fields = append(frame.Fields, data.NewField(v, nil, field))
+		} else if field, ok := textMap[v]; ok && len(field) == frameLen {
+			frame.Fields = append(frame.Fields, data.NewField(v, nil, field))
 		}
 	}
 	*frames = append(*frames, frame)
 }
 
-func (ds *SlsDatasource) BuildTable(logs []map[string]string, xcol string, ycols []string, keys []string, frames *data.Frames) {
+// BuildTable builds one field per ycol, numeric for columns whose values are all numbers, string otherwise.
+func (ds *SlsDatasource) BuildTable(logs []map[string]string, xcol string, ycols []string, keys []string, parser *TimeParser, frames *data.Frames) {
 	frame := data.NewFrame("response")
 
 	fieldMap := make(map[string][]string)
@@ -598,26 +885,30 @@ func (ds *SlsDatasource) BuildTable(logs []map[string]string, xcol string, ycols
 				fieldMap[k] = append(fieldMap[k], v)
 			}
 			if xcol != "" && xcol == k {
-				floatValue, err := strconv.ParseFloat(v, 64)
-				if err != nil {
-					log.DefaultLogger.Error("BuildTable", "ParseTime", err)
-					continue
+				if t, ok := parser.ParseColumn(xcol, v); ok {
+					times = append(times, t)
 				}
-				t := time.Unix(int64(floatValue), 0)
-				times = append(times, t)
 			}
 		}
 	}
 	for _, v := range keyArr {
+		if _, allNumeric := columnKind(logs, v); allNumeric {
+			values := make([]*float64, 0, len(fieldMap[v]))
+			for _, s := range fieldMap[v] {
+				values = append(values, parseFloatQuiet(s))
+			}
+			frame.Fields = append(frame.Fields, data.NewField(v, nil, values))
+			continue
+		}
 		frame.Fields = append(frame.Fields, data.NewField(v, nil, fieldMap[v]))
 	}
-	if len(times) > 0 {
+	if len(times) > 0 && len(times) == len(logs) {
 		frame.Fields = append(frame.Fields, data.NewField("time", nil, times))
 	}
 	*frames = append(*frames, frame)
 }
 
-func (ds *SlsDatasource) BuildLogs(logs []map[string]string, ycols []string, frames *data.Frames) {
+func (ds *SlsDatasource) BuildLogs(logs []map[string]string, ycols []string, logSource *LogSource, from int64, to int64, frames *data.Frames) {
 	frame := data.NewFrame("response")
 	frame.Meta = &data.FrameMeta{
 		PreferredVisualization: data.VisTypeLogs,
@@ -659,12 +950,14 @@ func (ds *SlsDatasource) BuildLogs(logs []map[string]string, ycols []string, fra
 		data.NewField("time", nil, times),
 		data.NewField("message", nil, values),
 	)
+	frame.Fields = append(frame.Fields, BuildDerivedFields(logs, values, logSource, from, to)...)
 	*frames = append(*frames, frame)
 }
 
 // BuildTrace
 // *| select traceID,spanID,parentSpanID,service,host,resource,attribute,statusCode,statusMessage,logs,name,start,duration limit 100
-func (ds *SlsDatasource) BuildTrace(logs []map[string]string, frames *data.Frames) {
+// Columns are read through schema, so OTel, Jaeger and Zipkin shaped spans are emitted the same way.
+func (ds *SlsDatasource) BuildTrace(logs []map[string]string, schema *TraceSchema, frames *data.Frames) {
 	frame := data.NewFrame("response")
 	frame.Meta = &data.FrameMeta{
 		PreferredVisualization: data.VisTypeTrace,
@@ -684,30 +977,30 @@ func (ds *SlsDatasource) BuildTrace(logs []map[string]string, frames *data.Frame
 	logs1 := make([]string, 0)
 	operationName := make([]string, 0)
 	for _, alog := range logs {
-		traceID = append(traceID, alog["traceID"])
-		spanID = append(spanID, alog["spanID"])
-		parentSpanID = append(parentSpanID, alog["parentSpanID"])
-		serviceName = append(serviceName, alog["service"])
-		host = append(host, alog["host"])
-		resource = append(resource, alog["resource"])
-		attribute = append(attribute, alog["attribute"])
-		statusCode = append(statusCode, alog["statusCode"])
-		statusMessage = append(statusMessage, alog["statusMessage"])
-		logs1 = append(logs1, alog["logs"])
-		operationName = append(operationName, alog["name"])
-		startTimeV, err := strconv.ParseFloat(alog["start"], 64)
+		traceID = append(traceID, alog[schema.TraceID])
+		spanID = append(spanID, alog[schema.SpanID])
+		parentSpanID = append(parentSpanID, alog[schema.ParentSpanID])
+		serviceName = append(serviceName, alog[schema.Service])
+		host = append(host, alog[schema.Host])
+		resource = append(resource, schema.Attributes(alog, schema.Resource))
+		attribute = append(attribute, schema.Attributes(alog, schema.Attribute))
+		statusCode = append(statusCode, normalizeStatusCode(alog[schema.StatusCode]))
+		statusMessage = append(statusMessage, alog[schema.StatusMessage])
+		logs1 = append(logs1, schema.SpanLogs(alog))
+		operationName = append(operationName, alog[schema.Operation])
+		startTimeV, err := strconv.ParseFloat(alog[schema.Start], 64)
 		if err != nil {
 			log.DefaultLogger.Error("BuildTrace", "ParseFloat", err)
 			startTime = append(startTime, 0)
 		} else {
-			startTime = append(startTime, startTimeV/1000)
+			startTime = append(startTime, schema.ToMillis(startTimeV))
 		}
-		durationV, err := strconv.ParseFloat(alog["duration"], 64)
+		durationV, err := schema.SpanDuration(alog)
 		if err != nil {
 			log.DefaultLogger.Error("BuildTrace", "ParseFloat", err)
 			duration = append(duration, 0)
 		} else {
-			duration = append(duration, durationV/1000)
+			duration = append(duration, schema.ToMillis(durationV))
 		}
 
 	}
@@ -726,32 +1019,3 @@ func (ds *SlsDatasource) BuildTrace(logs []map[string]string, frames *data.Frame
 	frame.Fields = append(frame.Fields, data.NewField("logs", nil, logs1))
 	*frames = append(*frames, frame)
 }
-
-func mapToSlice(timeArr []string, m map[string]float64) []float64 {
-	s := make([]float64, 0, len(timeArr))
-	for _, v := range timeArr {
-		s = append(s, m[v])
-	}
-	return s
-}
-
-func toTime(sTime string) (t time.Time) {
-	if v, err := strconv.ParseFloat(sTime, 64); err == nil {
-		if len(sTime) == 13 {
-			t = time.Unix(int64(v)/1000, 0)
-		} else {
-			t = time.Unix(int64(v), 0)
-		}
-		return
-	}
-	re := regexp.MustCompile(`(\d{4})\S(\d{2})\S(\d{2})[\s\S](\d{2})\S(\d{2})\S(\d{2}).*`)
-	matched := re.FindAllStringSubmatch(sTime, -1)
-	if matched != nil {
-		s := fmt.Sprintf("%s-%s-%s %s:%s:%s", matched[0][1], matched[0][2], matched[0][3],
-			matched[0][4], matched[0][5], matched[0][6])
-
-		local, _ := time.LoadLocation("Asia/Shanghai")
-		t, _ = time.ParseInLocation("2006-01-02 15:04:05", s, local)
-	}
-	return
-}
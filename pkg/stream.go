@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const (
+	// streamKindTail is the kind of a live tail stream.
+	streamKindTail = "tail"
+	// streamKindQuery is the kind of a streaming query.
+	streamKindQuery = "query"
+
+	// streamRegistryMax bounds the stream parameters remembered by a datasource.
+	streamRegistryMax = 1000
+)
+
+const (
+	RoleViewer = "Viewer"
+	RoleEditor = "Editor"
+	RoleAdmin  = "Admin"
+)
+
+// roleRanks orders the Grafana organization roles.
+var roleRanks = map[string]int{RoleViewer: 1, RoleEditor: 2, RoleAdmin: 3}
+
+// streamPath is the decoded path of a stream: <kind>/<project>/<logstore>/<hash>, the channel
+// scope already naming the datasource. The hash identifies the parameters of the stream,
+// registered when a query announced the channel.
+type streamPath struct {
+	Kind     string
+	Project  string
+	LogStore string
+	Hash     string
+}
+
+func (p *streamPath) String() string {
+	return strings.Join([]string{p.Kind, p.Project, p.LogStore, p.Hash}, "/")
+}
+
+// parseStreamPath decodes a stream path built by streamPath.String.
+func parseStreamPath(path string) (*streamPath, error) {
+	parts := strings.Split(path, "/")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("invalid stream path %s", path)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return nil, fmt.Errorf("invalid stream path %s", path)
+		}
+	}
+	if parts[0] != streamKindTail && parts[0] != streamKindQuery {
+		return nil, fmt.Errorf("invalid stream path %s: unknown kind %s", path, parts[0])
+	}
+	return &streamPath{Kind: parts[0], Project: parts[1], LogStore: parts[2], Hash: parts[3]}, nil
+}
+
+// streamHash returns the hash of the encoded parameters of a stream.
+func streamHash(params []byte) string {
+	sum := sha256.Sum256(params)
+	return hex.EncodeToString(sum[:16])
+}
+
+// registeredStream holds the parameters of a stream path.
+type registeredStream struct {
+	params []byte
+	added  time.Time
+}
+
+// registerStream remembers params for a stream of kind on the logstore of logSource and
+// returns its Grafana Live channel. When the registry is full, the oldest stream not
+// running is forgotten, or the oldest stream when all are running: a running stream
+// keeps its parameters, only new subscriptions to it are refused.
+func (ds *SlsDatasource) registerStream(logSource *LogSource, kind string, params []byte) string {
+	p := &streamPath{
+		Kind:     kind,
+		Project:  logSource.Project,
+		LogStore: logSource.LogStore,
+		Hash:     streamHash(params),
+	}
+	path := p.String()
+
+	ds.streamsMu.Lock()
+	defer ds.streamsMu.Unlock()
+	if ds.registry == nil {
+		ds.registry = make(map[string]*registeredStream)
+	}
+	if _, ok := ds.registry[path]; !ok && len(ds.registry) >= streamRegistryMax {
+		oldest, oldestIdle := "", ""
+		for k, r := range ds.registry {
+			if oldest == "" || r.added.Before(ds.registry[oldest].added) {
+				oldest = k
+			}
+			if !ds.streams[k] && (oldestIdle == "" || r.added.Before(ds.registry[oldestIdle].added)) {
+				oldestIdle = k
+			}
+		}
+		if oldestIdle != "" {
+			oldest = oldestIdle
+		}
+		delete(ds.registry, oldest)
+	}
+	ds.registry[path] = &registeredStream{params: params, added: time.Now()}
+	return "ds/" + logSource.UID + "/" + path
+}
+
+// streamParams returns the registered parameters of path.
+func (ds *SlsDatasource) streamParams(path string) ([]byte, bool) {
+	ds.streamsMu.Lock()
+	defer ds.streamsMu.Unlock()
+	r, ok := ds.registry[path]
+	if !ok {
+		return nil, false
+	}
+	return r.params, true
+}
+
+// userAllowed reports whether user has the role required for the live features of logSource.
+func userAllowed(user *backend.User, logSource *LogSource) bool {
+	return user != nil && roleAllowed(user.Role, logSource.StreamRole)
+}
+
+// roleAllowed reports whether role is at least the minimum role, Viewer by default.
+func roleAllowed(role string, minimum string) bool {
+	if minimum == "" {
+		minimum = RoleViewer
+	}
+	return roleRanks[role] >= roleRanks[minimum]
+}
+
+// lookupStream checks that path is a stream on an allowed logstore of this datasource, with
+// registered parameters. It returns the decoded path and its parameters, or the status refusing it.
+func (ds *SlsDatasource) lookupStream(logSource *LogSource, path string) (*streamPath, []byte, backend.SubscribeStreamStatus) {
+	p, err := parseStreamPath(path)
+	if err != nil {
+		return nil, nil, backend.SubscribeStreamStatusNotFound
+	}
+	if !logSource.logStoreAllowed(p.Project, p.LogStore) {
+		return nil, nil, backend.SubscribeStreamStatusPermissionDenied
+	}
+	params, ok := ds.streamParams(path)
+	if !ok {
+		return nil, nil, backend.SubscribeStreamStatusNotFound
+	}
+	return p, params, backend.SubscribeStreamStatusOK
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	// defaultStreamInterval is the delay between two runs of a streaming query.
+	defaultStreamInterval = 5 * time.Second
+	// defaultMaxStreams caps the streaming queries running at the same time for a datasource.
+	defaultMaxStreams = 10
+)
+
+// queryStream is a streaming query: the query JSON, rerun every interval over the last window.
+type queryStream struct {
+	Query         json.RawMessage `json:"q"`
+	Window        int64           `json:"w"`
+	Interval      int64           `json:"i,omitempty"`
+	MaxDataPoints int64           `json:"m,omitempty"`
+}
+
+// queryChannel registers the streaming form of query, which covers the query time range
+// ending now, and returns its channel.
+func (ds *SlsDatasource) queryChannel(logSource *LogSource, query backend.DataQuery) (string, error) {
+	var q map[string]interface{}
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return "", err
+	}
+	// the streamed runs must not announce a channel again
+	delete(q, "stream")
+	raw, _ := json.Marshal(q)
+	params, err := json.Marshal(&queryStream{
+		Query:         raw,
+		Window:        int64(query.TimeRange.Duration() / time.Second),
+		Interval:      int64(query.Interval / time.Millisecond),
+		MaxDataPoints: query.MaxDataPoints,
+	})
+	if err != nil {
+		return "", err
+	}
+	return ds.registerStream(logSource, streamKindQuery, params), nil
+}
+
+// parseQueryStream decodes the parameters registered by queryChannel.
+func parseQueryStream(params []byte) (*queryStream, error) {
+	s := &queryStream{}
+	if err := json.Unmarshal(params, s); err != nil {
+		return nil, fmt.Errorf("invalid streaming query: %s", err.Error())
+	}
+	if s.Window <= 0 {
+		return nil, fmt.Errorf("invalid streaming query: empty window")
+	}
+	return s, nil
+}
+
+// streamInterval parses the refresh interval of a streaming query, at least one second.
+func streamInterval(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultStreamInterval, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid stream interval: %s", err.Error())
+	}
+	if d < time.Second {
+		return 0, fmt.Errorf("invalid stream interval: %s is less than 1s", s)
+	}
+	return d, nil
+}
+
+// acquireStream registers a running stream, it fails when the datasource runs maxStreams already.
+func (ds *SlsDatasource) acquireStream(path string, maxStreams int) error {
+	ds.streamsMu.Lock()
+	defer ds.streamsMu.Unlock()
+	if ds.streams == nil {
+		ds.streams = make(map[string]bool)
+	}
+	if maxStreams <= 0 {
+		maxStreams = defaultMaxStreams
+	}
+	if len(ds.streams) >= maxStreams {
+		return fmt.Errorf("too many streaming queries, at most %d can run at the same time", maxStreams)
+	}
+	ds.streams[path] = true
+	return nil
+}
+
+func (ds *SlsDatasource) releaseStream(path string) {
+	ds.streamsMu.Lock()
+	defer ds.streamsMu.Unlock()
+	delete(ds.streams, path)
+}
+
+// streamFull reports whether a new stream would exceed the cap, running ones are always accepted.
+func (ds *SlsDatasource) streamFull(path string, maxStreams int) bool {
+	ds.streamsMu.Lock()
+	defer ds.streamsMu.Unlock()
+	if maxStreams <= 0 {
+		maxStreams = defaultMaxStreams
+	}
+	return !ds.streams[path] && len(ds.streams) >= maxStreams
+}
+
+// StreamQuery reruns the query of stream over a window sliding to now and sends the rows that
+// are new or changed since the previous run. Grafana runs one StreamQuery per channel, shared by
+// its subscribers, and cancels ctx once the last one left.
+func (ds *SlsDatasource) StreamQuery(ctx context.Context, logSource *LogSource, path string, stream *queryStream,
+	sender *backend.StreamSender) error {
+	queryInfo := &QueryInfo{}
+	if err := json.Unmarshal(stream.Query, queryInfo); err != nil {
+		return err
+	}
+	interval, err := streamInterval(queryInfo.StreamInterval)
+	if err != nil {
+		return err
+	}
+	if err = ds.acquireStream(path, logSource.MaxStreams); err != nil {
+		return err
+	}
+	defer ds.releaseStream(path)
+
+	client := NewClient(logSource)
+	sent := make(map[string]string)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.DefaultLogger.Info("Context done, finish streaming", "path", path)
+			return nil
+		case <-ticker.C:
+			now := time.Now()
+			ch := make(chan Result, 1)
+			ds.QueryLogs(ch, backend.DataQuery{
+				RefID:         "A",
+				JSON:          stream.Query,
+				Interval:      time.Duration(stream.Interval) * time.Millisecond,
+				MaxDataPoints: stream.MaxDataPoints,
+				TimeRange: backend.TimeRange{
+					From: now.Add(-time.Duration(stream.Window) * time.Second),
+					To:   now,
+				},
+			}, client, logSource)
+			res := <-ch
+			if res.dataResponse.Error != nil {
+				log.DefaultLogger.Error("StreamQuery", "path", path, "error", res.dataResponse.Error)
+				continue
+			}
+			current := make(map[string]string)
+			for i, frame := range res.dataResponse.Frames {
+				if changed := changedRows(frame, i, sent, current); changed != nil {
+					if err := sender.SendFrame(changed, data.IncludeAll); err != nil {
+						log.DefaultLogger.Error("Error sending frame", "error", err)
+					}
+				}
+			}
+			// points that left the window are forgotten
+			sent = current
+		}
+	}
+}
+
+// changedRows returns the rows of frame whose values differ from sent, keyed by frame index
+// and time, or nil when nothing changed. The values of every row are recorded in current.
+func changedRows(frame *data.Frame, index int, sent map[string]string, current map[string]string) *data.Frame {
+	rows, err := frame.RowLen()
+	if err != nil || rows == 0 {
+		return nil
+	}
+	tf := -1
+	for i, field := range frame.Fields {
+		if field.Type().Time() {
+			tf = i
+			break
+		}
+	}
+	changed := frame.EmptyCopy()
+	for i, field := range changed.Fields {
+		field.Config = frame.Fields[i].Config
+	}
+	for row := 0; row < rows; row++ {
+		values := frame.RowCopy(row)
+		key := fmt.Sprintf("%d/%d", index, row)
+		if tf >= 0 {
+			if t, ok := frame.ConcreteAt(tf, row); ok {
+				key = fmt.Sprintf("%d/%d", index, t.(time.Time).UnixNano())
+			}
+		}
+		signature := rowSignature(values)
+		current[key] = signature
+		if sent[key] != signature {
+			changed.AppendRow(values...)
+		}
+	}
+	if changed.Rows() == 0 {
+		return nil
+	}
+	return changed
+}
+
+func rowSignature(values []interface{}) string {
+	var b strings.Builder
+	for _, v := range values {
+		switch p := v.(type) {
+		case *float64:
+			if p == nil {
+				b.WriteString("null")
+			} else {
+				fmt.Fprint(&b, *p)
+			}
+		default:
+			fmt.Fprint(&b, v)
+		}
+		b.WriteByte(0)
+	}
+	return b.String()
+}
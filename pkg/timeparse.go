@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	// zoneinfo for platforms without a system tz database, e.g. windows
+	_ "time/tzdata"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// defaultTimezone is used when the datasource does not set one, SLS renders
+// time_series and date_format results in this timezone by default.
+const defaultTimezone = "Asia/Shanghai"
+
+// timeLayouts are tried in order for non numeric time values.
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006/01/02 15:04:05.999999999",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	time.RFC1123Z,
+	time.RFC1123,
+}
+
+// looseTimeRe matches YYYY?MM?DD?HH?MM?SS with any separators.
+var looseTimeRe = regexp.MustCompile(`(\d{4})\S(\d{2})\S(\d{2})[\s\S](\d{2})\S(\d{2})\S(\d{2})`)
+
+// offsetRe matches fixed UTC offsets such as +08:00, -0530 or UTC+8.
+var offsetRe = regexp.MustCompile(`^(?:UTC|GMT)?([+-])(\d{1,2}):?(\d{2})?$`)
+
+// slsLayoutReplacer converts the MySQL style date_format patterns used in SLS SQL to Go layouts.
+var slsLayoutReplacer = strings.NewReplacer(
+	"%Y", "2006", "%y", "06", "%m", "01", "%c", "1", "%d", "02", "%e", "2",
+	"%H", "15", "%k", "15", "%h", "03", "%I", "03", "%l", "3", "%i", "04",
+	"%s", "05", "%S", "05", "%f", "000000", "%p", "PM", "%b", "Jan", "%M", "January",
+	"%a", "Mon", "%W", "Monday", "%T", "15:04:05", "%%", "%",
+)
+
+// TimeParser parses time column values returned by SLS: epochs in seconds,
+// milliseconds, microseconds or nanoseconds, RFC3339/ISO8601 strings and
+// per query layouts. A query layout is tried before epochs, so that all-digit
+// layouts like %Y%m%d are not read as epochs. Values without an offset are read in Location.
+// A TimeParser records the values it could not parse, it is not safe for concurrent use.
+type TimeParser struct {
+	Location *time.Location
+	Layouts  []string
+
+	// custom is the query layout, also the first of Layouts
+	custom   string
+	failures int
+	sample   string
+	column   string
+}
+
+// NewTimeParser returns a parser for the datasource timezone and an optional
+// query layout, either a Go layout or an SLS date_format pattern like %Y-%m-%d %H:%i:%s.
+func NewTimeParser(timezone string, layout string) (*TimeParser, error) {
+	location, err := loadLocation(timezone)
+	if err != nil {
+		return nil, err
+	}
+	p := &TimeParser{Location: location}
+	if layout != "" {
+		if strings.Contains(layout, "%") {
+			layout = slsLayoutReplacer.Replace(layout)
+		}
+		p.custom = layout
+		p.Layouts = append(p.Layouts, layout)
+	}
+	p.Layouts = append(p.Layouts, timeLayouts...)
+	return p, nil
+}
+
+func loadLocation(timezone string) (*time.Location, error) {
+	if timezone == "" {
+		timezone = defaultTimezone
+	}
+	if m := offsetRe.FindStringSubmatch(timezone); m != nil {
+		hours, _ := strconv.Atoi(m[2])
+		minutes, _ := strconv.Atoi(m[3])
+		offset := hours*3600 + minutes*60
+		if m[1] == "-" {
+			offset = -offset
+		}
+		return time.FixedZone(timezone, offset), nil
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %s: %s", timezone, err.Error())
+	}
+	return location, nil
+}
+
+// Parse parses one time value.
+func (p *TimeParser) Parse(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if p.custom != "" {
+		if t, err := time.ParseInLocation(p.custom, s, p.Location); err == nil {
+			return t, nil
+		}
+	}
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return parseEpochInt(v), nil
+	}
+	if v, err := strconv.ParseFloat(s, 64); err == nil {
+		return parseEpoch(v)
+	}
+	for _, layout := range p.Layouts {
+		if t, err := time.ParseInLocation(layout, s, p.Location); err == nil {
+			return t, nil
+		}
+	}
+	if m := looseTimeRe.FindStringSubmatch(s); m != nil {
+		return time.ParseInLocation("2006-01-02 15:04:05",
+			fmt.Sprintf("%s-%s-%s %s:%s:%s", m[1], m[2], m[3], m[4], m[5], m[6]), p.Location)
+	}
+	return time.Time{}, fmt.Errorf("unparseable time %q", s)
+}
+
+// parseEpoch picks the unit of an epoch from its magnitude, which is
+// unambiguous for any time between 1973 and 5138.
+func parseEpoch(v float64) (time.Time, error) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return time.Time{}, fmt.Errorf("unparseable time %v", v)
+	}
+	abs := math.Abs(v)
+	switch {
+	case abs < 1e11:
+		sec, frac := math.Modf(v)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	case abs < 1e14:
+		return time.Unix(0, int64(v*1e6)), nil
+	case abs < 1e17:
+		return time.Unix(0, int64(v*1e3)), nil
+	default:
+		return time.Unix(0, int64(v)), nil
+	}
+}
+
+// parseEpochInt is parseEpoch without the float rounding of large epochs.
+func parseEpochInt(v int64) time.Time {
+	abs := v
+	if abs < 0 {
+		abs = -abs
+	}
+	switch {
+	case abs < 1e11:
+		return time.Unix(v, 0)
+	case abs < 1e14:
+		return time.Unix(0, v*int64(time.Millisecond))
+	case abs < 1e17:
+		return time.Unix(0, v*int64(time.Microsecond))
+	default:
+		return time.Unix(0, v)
+	}
+}
+
+// ParseColumn parses value v of column col, recording it when it cannot be parsed.
+func (p *TimeParser) ParseColumn(col string, v string) (time.Time, bool) {
+	t, err := p.Parse(v)
+	if err != nil {
+		if p.failures == 0 {
+			p.sample = v
+			p.column = col
+		}
+		p.failures++
+		return t, false
+	}
+	return t, true
+}
+
+// SortByTime parses column col of every log and returns the logs whose time
+// could be parsed together with their times, ordered by time.
+func (p *TimeParser) SortByTime(logs []map[string]string, col string) ([]map[string]string, []time.Time) {
+	rows := make([]map[string]string, 0, len(logs))
+	times := make([]time.Time, 0, len(logs))
+	for _, alog := range logs {
+		if t, ok := p.ParseColumn(col, alog[col]); ok {
+			rows = append(rows, alog)
+			times = append(times, t)
+		}
+	}
+	sort.Stable(&rowsByTime{rows: rows, times: times})
+	return rows, times
+}
+
+// Notices reports the values that could not be parsed, if any.
+func (p *TimeParser) Notices() []data.Notice {
+	if p.failures == 0 {
+		return nil
+	}
+	return []data.Notice{{
+		Severity: data.NoticeSeverityWarning,
+		Text: fmt.Sprintf("%d value(s) of column %s could not be parsed as time and were skipped, e.g. %q",
+			p.failures, p.column, p.sample),
+	}}
+}
+
+type rowsByTime struct {
+	rows  []map[string]string
+	times []time.Time
+}
+
+func (r *rowsByTime) Len() int           { return len(r.rows) }
+func (r *rowsByTime) Less(i, j int) bool { return r.times[i].Before(r.times[j]) }
+func (r *rowsByTime) Swap(i, j int) {
+	r.rows[i], r.rows[j] = r.rows[j], r.rows[i]
+	r.times[i], r.times[j] = r.times[j], r.times[i]
+}
+
+// appendNotices attaches notices to the first frame.
+func appendNotices(frames data.Frames, notices ...data.Notice) {
+	if len(frames) == 0 || len(notices) == 0 {
+		return
+	}
+	if frames[0].Meta == nil {
+		frames[0].Meta = &data.FrameMeta{}
+	}
+	frames[0].Meta.Notices = append(frames[0].Meta.Notices, notices...)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeParserDigitLayouts(t *testing.T) {
+	shanghai := time.FixedZone("+08:00", 8*3600)
+	tests := []struct {
+		layout string
+		value  string
+		want   time.Time
+	}{
+		{"%Y%m%d", "20231019", time.Date(2023, 10, 19, 0, 0, 0, 0, shanghai)},
+		{"%Y%m%d%H%i", "202310191230", time.Date(2023, 10, 19, 12, 30, 0, 0, shanghai)},
+		{"%Y%m%d%H%i%s", "20231019123045", time.Date(2023, 10, 19, 12, 30, 45, 0, shanghai)},
+		{"20060102", "20231019", time.Date(2023, 10, 19, 0, 0, 0, 0, shanghai)},
+		// values not matching the layout still fall back to epochs
+		{"%Y%m%d", "1697688000", time.Unix(1697688000, 0)},
+		{"%Y%m%d", "1697688000123", time.Unix(0, 1697688000123*int64(time.Millisecond))},
+		// without a layout, digits are epochs
+		{"", "1697688000", time.Unix(1697688000, 0)},
+	}
+	for _, tt := range tests {
+		p, err := NewTimeParser("+08:00", tt.layout)
+		if err != nil {
+			t.Fatalf("NewTimeParser(%q): %v", tt.layout, err)
+		}
+		got, err := p.Parse(tt.value)
+		if err != nil {
+			t.Errorf("Parse(%q) with layout %q: %v", tt.value, tt.layout, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("Parse(%q) with layout %q = %v, want %v", tt.value, tt.layout, got, tt.want)
+		}
+	}
+}
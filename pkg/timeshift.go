@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	// CompareRatio adds current / shifted series for every time shift.
+	CompareRatio = "ratio"
+	// CompareDiff adds current - shifted series for every time shift.
+	CompareDiff = "diff"
+)
+
+// timeShift is one comparison period of a query, e.g. 1d.
+type timeShift struct {
+	label    string
+	duration time.Duration
+}
+
+// parseTimeShifts parses comma separated shifts such as 1h, 1d or 7d.
+func parseTimeShifts(s string) ([]timeShift, error) {
+	var shifts []timeShift
+	for _, v := range splitColumns(s) {
+		d, err := parseChunkDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time shift %s: %s", v, err.Error())
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid time shift %s: must be positive", v)
+		}
+		shifts = append(shifts, timeShift{label: v, duration: d})
+	}
+	return shifts, nil
+}
+
+// GetLogsRange runs the query over [from, to), in chunks when plan is set and the query allows it.
+func (ds *SlsDatasource) GetLogsRange(client *sls.Client, logSource *LogSource, queryInfo *QueryInfo,
+	from int64, to int64, plan *chunkPlan) (*sls.GetLogsResponse, []data.Notice, error) {
+	if plan != nil && isChunkable(queryInfo.Xcol, queryInfo.Query) {
+		return ds.GetLogsChunked(client, logSource, queryInfo, from, to, plan)
+	}
+	offset := (queryInfo.CurrentPage - 1) * queryInfo.LogsPerPage
+	getLogsResp, err := client.GetLogs(logSource.Project, logSource.LogStore, "",
+		from, to, queryInfo.Query, queryInfo.LogsPerPage, offset, true)
+	return getLogsResp, nil, err
+}
+
+// AppendTimeShifts runs the query for every shifted time range, builds the result with build
+// and appends it moved back to the current range, with " <shift> ago" appended to the series
+// names. With compare set, ratio or difference series against the current frames are added.
+// Failed shifts are returned as notices.
+func (ds *SlsDatasource) AppendTimeShifts(client *sls.Client, logSource *LogSource, queryInfo *QueryInfo,
+	from int64, to int64, plan *chunkPlan, shifts []timeShift,
+	build func(logs []map[string]string, keys []string, frames *data.Frames), frames *data.Frames) []data.Notice {
+	var notices []data.Notice
+	current := append(data.Frames(nil), *frames...)
+	for _, shift := range shifts {
+		seconds := int64(shift.duration / time.Second)
+		getLogsResp, rangeNotices, err := ds.GetLogsRange(client, logSource, queryInfo, from-seconds, to-seconds, plan)
+		if err != nil {
+			log.DefaultLogger.Error("AppendTimeShifts", "shift", shift.label, "error", err)
+			notices = append(notices, data.Notice{
+				Severity: data.NoticeSeverityError,
+				Text:     fmt.Sprintf("time shift %s failed: %s", shift.label, err.Error()),
+			})
+			continue
+		}
+		notices = append(notices, rangeNotices...)
+		c := &Contents{}
+		if getLogsResp.Contents != "" {
+			_ = json.Unmarshal([]byte(getLogsResp.Contents), &c)
+		}
+		var shifted data.Frames
+		build(getLogsResp.Logs, c.Keys, &shifted)
+		suffix := " " + shift.label + " ago"
+		for _, frame := range shifted {
+			shiftFrame(frame, shift.duration, suffix)
+			*frames = append(*frames, frame)
+		}
+		if queryInfo.Compare == CompareRatio || queryInfo.Compare == CompareDiff {
+			for i := 0; i < len(current) && i < len(shifted); i++ {
+				if frame := compareFrames(current[i], shifted[i], queryInfo.Compare, suffix); frame != nil {
+					*frames = append(*frames, frame)
+				}
+			}
+		}
+	}
+	return notices
+}
+
+// shiftFrame moves the time fields of frame forward by d and appends suffix to the other fields.
+func shiftFrame(frame *data.Frame, d time.Duration, suffix string) {
+	for _, field := range frame.Fields {
+		if field.Type().Time() {
+			for i := 0; i < field.Len(); i++ {
+				if v, ok := field.ConcreteAt(i); ok {
+					field.SetConcrete(i, v.(time.Time).Add(d))
+				}
+			}
+			continue
+		}
+		field.Name += suffix
+		if field.Config != nil && field.Config.DisplayNameFromDS != "" {
+			field.Config.DisplayNameFromDS += suffix
+		}
+	}
+}
+
+// compareFrames returns, at the times of current, the ratio or difference of every numeric
+// field of current and the field of shifted named with suffix. Missing points are null.
+func compareFrames(current *data.Frame, shifted *data.Frame, compare string, suffix string) *data.Frame {
+	currentTime, shiftedTime := timeField(current), timeField(shifted)
+	if currentTime == nil || shiftedTime == nil {
+		return nil
+	}
+	rows := make(map[int64]int, shiftedTime.Len())
+	for i := 0; i < shiftedTime.Len(); i++ {
+		if v, ok := shiftedTime.ConcreteAt(i); ok {
+			rows[v.(time.Time).UnixNano()] = i
+		}
+	}
+	frame := data.NewFrame(current.Name)
+	frame.Fields = append(frame.Fields, data.NewFieldFromFieldType(currentTime.Type(), 0))
+	frame.Fields[0].Name = currentTime.Name
+	for i := 0; i < currentTime.Len(); i++ {
+		frame.Fields[0].Append(currentTime.CopyAt(i))
+	}
+
+	op := " - "
+	if compare == CompareRatio {
+		op = " / "
+	}
+	for _, field := range current.Fields {
+		if !field.Type().Numeric() {
+			continue
+		}
+		other := fieldByName(shifted, field.Name+suffix)
+		if other == nil || !other.Type().Numeric() {
+			continue
+		}
+		values := make([]*float64, 0, currentTime.Len())
+		for row := 0; row < currentTime.Len(); row++ {
+			var value *float64
+			t, ok := currentTime.ConcreteAt(row)
+			if j, found := rows[t.(time.Time).UnixNano()]; ok && found {
+				a, errA := field.FloatAt(row)
+				b, errB := other.FloatAt(j)
+				if errA == nil && errB == nil {
+					value = compareValues(a, b, compare)
+				}
+			}
+			values = append(values, value)
+		}
+		name := field.Name + op + field.Name + suffix
+		out := data.NewField(name, field.Labels, values)
+		if field.Config != nil && field.Config.DisplayNameFromDS != "" {
+			display := field.Config.DisplayNameFromDS
+			out.Config = &data.FieldConfig{DisplayNameFromDS: display + op + display + suffix}
+		}
+		frame.Fields = append(frame.Fields, out)
+	}
+	if len(frame.Fields) < 2 {
+		return nil
+	}
+	return frame
+}
+
+// compareValues returns a / b or a - b, nil when a value is missing or b is 0 for a ratio.
+func compareValues(a float64, b float64, compare string) *float64 {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return nil
+	}
+	var v float64
+	if compare == CompareRatio {
+		if b == 0 {
+			return nil
+		}
+		v = a / b
+	} else {
+		v = a - b
+	}
+	return &v
+}
+
+// timeField returns the first time field of frame.
+func timeField(frame *data.Frame) *data.Field {
+	for _, field := range frame.Fields {
+		if field.Type().Time() {
+			return field
+		}
+	}
+	return nil
+}
+
+// fieldByName returns the field of frame named name.
+func fieldByName(frame *data.Frame, name string) *data.Field {
+	for _, field := range frame.Fields {
+		if field.Name == name {
+			return field
+		}
+	}
+	return nil
+}
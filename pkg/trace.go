@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	// traceSpansPerPage is the page size used when fetching the spans of a single trace.
+	traceSpansPerPage int64 = 100
+	// maxTraceSpans bounds the number of spans fetched for a single trace.
+	maxTraceSpans = 10000
+	// defaultTraceSearchLimit is used when the query does not set logsPerPage.
+	defaultTraceSearchLimit int64 = 20
+)
+
+// QueryTraceByID fetches every span of queryInfo.TraceID and builds a trace frame.
+func (ds *SlsDatasource) QueryTraceByID(client *sls.Client, logSource *LogSource, queryInfo *QueryInfo,
+	from int64, to int64, frames *data.Frames) error {
+	if queryInfo.TraceID == "" {
+		return fmt.Errorf("trace id is required")
+	}
+	spans, truncated, err := ds.GetTraceSpans(client, logSource, queryInfo.TraceID, from, to)
+	if err != nil {
+		return err
+	}
+	ds.BuildTrace(spans, &logSource.TraceSchema, frames)
+	if truncated {
+		appendNotices(*frames, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("trace %s was cut at %d spans, later spans may be missing", queryInfo.TraceID, maxTraceSpans),
+		})
+	}
+	return nil
+}
+
+// GetTraceSpans pages through the logstore until all spans of traceID are returned, or
+// maxTraceSpans of them, reporting then whether more spans may be left.
+func (ds *SlsDatasource) GetTraceSpans(client *sls.Client, logSource *LogSource, traceID string,
+	from int64, to int64) ([]map[string]string, bool, error) {
+	query := logSource.TraceSchema.TraceID + ": " + quoteSearchValue(traceID)
+	var spans []map[string]string
+	for offset := int64(0); offset < maxTraceSpans; offset += traceSpansPerPage {
+		getLogsResp, err := client.GetLogs(logSource.Project, logSource.LogStore, "",
+			from, to, query, traceSpansPerPage, offset, false)
+		if err != nil {
+			log.DefaultLogger.Error("GetTraceSpans", "traceID", traceID, "offset", offset, "error", err)
+			return nil, false, err
+		}
+		spans = append(spans, getLogsResp.Logs...)
+		if int64(len(getLogsResp.Logs)) < traceSpansPerPage {
+			return spans, false, nil
+		}
+	}
+	// a full last page: check whether the trace has more spans
+	getLogsResp, err := client.GetLogs(logSource.Project, logSource.LogStore, "",
+		from, to, query, 1, maxTraceSpans, false)
+	if err != nil {
+		// unknown, flag the trace rather than showing it as complete
+		log.DefaultLogger.Error("GetTraceSpans", "traceID", traceID, "offset", maxTraceSpans, "error", err)
+		return spans, true, nil
+	}
+	return spans, len(getLogsResp.Logs) > 0, nil
+}
+
+// QueryTraceSearch finds traces matching the service, operation, duration and status
+// filters of queryInfo and builds a table with one row per trace.
+func (ds *SlsDatasource) QueryTraceSearch(client *sls.Client, logSource *LogSource, queryInfo *QueryInfo,
+	from int64, to int64, frames *data.Frames) error {
+	query, err := buildTraceSearchQuery(queryInfo, &logSource.TraceSchema)
+	if err != nil {
+		return err
+	}
+	log.DefaultLogger.Info("QueryTraceSearch", "query", query)
+	getLogsResp, err := client.GetLogs(logSource.Project, logSource.LogStore, "",
+		from, to, query, 0, 0, true)
+	if err != nil {
+		log.DefaultLogger.Error("QueryTraceSearch", "query", query, "error", err)
+		return err
+	}
+	ds.BuildTraceSearch(getLogsResp.Logs, logSource, from, to, frames)
+	return nil
+}
+
+// buildTraceSearchQuery selects the most recent traces having at least one span that
+// matches every filter, then aggregates all spans of those traces.
+func buildTraceSearchQuery(queryInfo *QueryInfo, schema *TraceSchema) (string, error) {
+	traceID := quoteSQLIdent(schema.TraceID)
+	start := quoteSQLIdent(schema.Start)
+	duration := schema.DurationExpr()
+	var conditions []string
+	if queryInfo.Service != "" {
+		conditions = append(conditions, quoteSQLIdent(schema.Service)+" = "+quoteSQLValue(queryInfo.Service))
+	}
+	if queryInfo.Operation != "" {
+		conditions = append(conditions, quoteSQLIdent(schema.Operation)+" = "+quoteSQLValue(queryInfo.Operation))
+	}
+	switch strings.ToUpper(queryInfo.Status) {
+	case "":
+	case "ERROR":
+		conditions = append(conditions, schema.ErrorExpr(""))
+	case "OK":
+		conditions = append(conditions, "not "+schema.ErrorExpr(""))
+	default:
+		conditions = append(conditions, "cast("+quoteSQLIdent(schema.StatusCode)+" as varchar) = "+quoteSQLValue(queryInfo.Status))
+	}
+	if queryInfo.MinDuration != "" {
+		d, err := time.ParseDuration(queryInfo.MinDuration)
+		if err != nil {
+			return "", fmt.Errorf("invalid minDuration: %s", err.Error())
+		}
+		conditions = append(conditions, duration+" >= "+strconv.FormatInt(schema.FromNanos(d.Nanoseconds()), 10))
+	}
+	if queryInfo.MaxDuration != "" {
+		d, err := time.ParseDuration(queryInfo.MaxDuration)
+		if err != nil {
+			return "", fmt.Errorf("invalid maxDuration: %s", err.Error())
+		}
+		conditions = append(conditions, duration+" <= "+strconv.FormatInt(schema.FromNanos(d.Nanoseconds()), 10))
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = " where " + strings.Join(conditions, " and ")
+	}
+	limit := queryInfo.LogsPerPage
+	if limit <= 0 {
+		limit = defaultTraceSearchLimit
+	}
+	isRoot := fmt.Sprintf("coalesce(%s, '') = ''", quoteSQLIdent(schema.ParentSpanID))
+	return fmt.Sprintf("* | select %[1]s as traceID, min(%[2]s) as start, max(%[2]s + %[3]s) - min(%[2]s) as duration, "+
+		"count(1) as spans, "+
+		"max(case when %[4]s then %[5]s end) as rootService, "+
+		"max(case when %[4]s then %[6]s end) as rootOperation "+
+		"from log where %[1]s in (select %[1]s from log%[7]s group by %[1]s order by max(%[2]s) desc limit %[8]d) "+
+		"group by %[1]s order by start desc limit %[8]d",
+		traceID, start, duration, isRoot, quoteSQLIdent(schema.Service), quoteSQLIdent(schema.Operation),
+		where, limit), nil
+}
+
+// BuildTraceSearch
+// one row per trace, traceID links to the trace_id query of this datasource
+func (ds *SlsDatasource) BuildTraceSearch(logs []map[string]string, logSource *LogSource, from int64, to int64, frames *data.Frames) {
+	frame := data.NewFrame("traces")
+	frame.Meta = &data.FrameMeta{
+		PreferredVisualization: data.VisTypeTable,
+	}
+
+	traceID := make([]string, 0)
+	rootService := make([]string, 0)
+	rootOperation := make([]string, 0)
+	startTime := make([]time.Time, 0)
+	duration := make([]float64, 0)
+	spans := make([]int64, 0)
+	for _, alog := range logs {
+		traceID = append(traceID, alog["traceID"])
+		rootService = append(rootService, alog["rootService"])
+		rootOperation = append(rootOperation, alog["rootOperation"])
+		startV, err := strconv.ParseFloat(alog["start"], 64)
+		if err != nil {
+			log.DefaultLogger.Error("BuildTraceSearch", "ParseFloat", err)
+		}
+		startTime = append(startTime, time.Unix(0, int64(logSource.TraceSchema.ToMillis(startV)*1e6)))
+		durationV, err := strconv.ParseFloat(alog["duration"], 64)
+		if err != nil {
+			log.DefaultLogger.Error("BuildTraceSearch", "ParseFloat", err)
+		}
+		duration = append(duration, logSource.TraceSchema.ToMillis(durationV))
+		spansV, err := strconv.ParseInt(alog["spans"], 10, 64)
+		if err != nil {
+			log.DefaultLogger.Error("BuildTraceSearch", "ParseInt", err)
+		}
+		spans = append(spans, spansV)
+	}
+
+	traceIDField := data.NewField("traceID", nil, traceID)
+	traceIDField.Config = &data.FieldConfig{
+		Links: []data.DataLink{{
+			Title: "Open trace",
+			URL: exploreURL(logSource.Name, map[string]interface{}{
+				"type":    QueryTypeTraceID,
+				"traceId": valueRawVariable,
+			}, from, to),
+		}},
+	}
+	durationField := data.NewField("duration", nil, duration)
+	durationField.Config = &data.FieldConfig{Unit: "ms"}
+
+	frame.Fields = append(frame.Fields, traceIDField)
+	frame.Fields = append(frame.Fields, data.NewField("startTime", nil, startTime))
+	frame.Fields = append(frame.Fields, data.NewField("rootService", nil, rootService))
+	frame.Fields = append(frame.Fields, data.NewField("rootOperation", nil, rootOperation))
+	frame.Fields = append(frame.Fields, durationField)
+	frame.Fields = append(frame.Fields, data.NewField("spans", nil, spans))
+	*frames = append(*frames, frame)
+}
+
+// quoteSearchValue quotes v as a phrase in SLS search syntax.
+func quoteSearchValue(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+}
+
+// quoteSQLValue quotes v as a SQL string literal.
+func quoteSQLValue(v string) string {
+	return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	TracePresetSLS    = "sls"
+	TracePresetOTel   = "otel"
+	TracePresetJaeger = "jaeger"
+	TracePresetZipkin = "zipkin"
+
+	// AttributeLayoutJSON stores attributes as a JSON object in one column.
+	AttributeLayoutJSON = "json"
+	// AttributeLayoutKVArray stores attributes as a JSON array of {"key":..,"value":..} objects.
+	AttributeLayoutKVArray = "kv_array"
+	// AttributeLayoutPrefix stores every attribute in its own column, Resource and
+	// Attribute of the schema are then column name prefixes.
+	AttributeLayoutPrefix = "prefix"
+)
+
+// TraceSchema maps the span columns of a trace logstore to the fields BuildTrace emits.
+// Empty fields are taken from the preset, which defaults to the SLS Trace schema.
+type TraceSchema struct {
+	Preset          string `json:"preset"`
+	TraceID         string `json:"traceId"`
+	SpanID          string `json:"spanId"`
+	ParentSpanID    string `json:"parentSpanId"`
+	Service         string `json:"service"`
+	Operation       string `json:"operation"`
+	Start           string `json:"start"`
+	End             string `json:"end"`
+	Duration        string `json:"duration"`
+	TimeUnit        string `json:"timeUnit"`
+	StatusCode      string `json:"statusCode"`
+	StatusMessage   string `json:"statusMessage"`
+	Host            string `json:"host"`
+	Resource        string `json:"resource"`
+	Attribute       string `json:"attribute"`
+	Logs            string `json:"logs"`
+	AttributeLayout string `json:"attributeLayout"`
+}
+
+var traceSchemaPresets = map[string]TraceSchema{
+	TracePresetSLS: {
+		TraceID:         "traceID",
+		SpanID:          "spanID",
+		ParentSpanID:    "parentSpanID",
+		Service:         "service",
+		Operation:       "name",
+		Start:           "start",
+		End:             "end",
+		Duration:        "duration",
+		TimeUnit:        "us",
+		StatusCode:      "statusCode",
+		StatusMessage:   "statusMessage",
+		Host:            "host",
+		Resource:        "resource",
+		Attribute:       "attribute",
+		Logs:            "logs",
+		AttributeLayout: AttributeLayoutJSON,
+	},
+	TracePresetOTel: {
+		TraceID:         "trace_id",
+		SpanID:          "span_id",
+		ParentSpanID:    "parent_span_id",
+		Service:         "resource.service.name",
+		Operation:       "name",
+		Start:           "start_time_unix_nano",
+		End:             "end_time_unix_nano",
+		TimeUnit:        "ns",
+		StatusCode:      "status_code",
+		StatusMessage:   "status_message",
+		Host:            "resource.host.name",
+		Resource:        "resource.",
+		Attribute:       "attributes.",
+		Logs:            "events",
+		AttributeLayout: AttributeLayoutPrefix,
+	},
+	TracePresetJaeger: {
+		TraceID:         "traceID",
+		SpanID:          "spanID",
+		ParentSpanID:    "parentSpanID",
+		Service:         "process.serviceName",
+		Operation:       "operationName",
+		Start:           "startTime",
+		Duration:        "duration",
+		TimeUnit:        "us",
+		StatusCode:      "statusCode",
+		StatusMessage:   "statusMessage",
+		Host:            "process.hostname",
+		Resource:        "process.tags",
+		Attribute:       "tags",
+		Logs:            "logs",
+		AttributeLayout: AttributeLayoutKVArray,
+	},
+	TracePresetZipkin: {
+		TraceID:         "traceId",
+		SpanID:          "id",
+		ParentSpanID:    "parentId",
+		Service:         "localEndpoint.serviceName",
+		Operation:       "name",
+		Start:           "timestamp",
+		Duration:        "duration",
+		TimeUnit:        "us",
+		StatusCode:      "tags.error",
+		Host:            "localEndpoint.ipv4",
+		Resource:        "localEndpoint",
+		Attribute:       "tags",
+		Logs:            "annotations",
+		AttributeLayout: AttributeLayoutJSON,
+	},
+}
+
+// timeUnitNanos is the number of nanoseconds in one unit of each supported time unit.
+var timeUnitNanos = map[string]float64{
+	"s":  1e9,
+	"ms": 1e6,
+	"us": 1e3,
+	"ns": 1,
+}
+
+// Resolve fills the empty fields of s from its preset and validates the result.
+func (s TraceSchema) Resolve() (TraceSchema, error) {
+	if s.Preset == "" {
+		s.Preset = TracePresetSLS
+	}
+	preset, ok := traceSchemaPresets[s.Preset]
+	if !ok {
+		return s, fmt.Errorf("unknown trace schema preset: %s", s.Preset)
+	}
+	fill := func(v *string, def string) {
+		if *v == "" {
+			*v = def
+		}
+	}
+	fill(&s.TraceID, preset.TraceID)
+	fill(&s.SpanID, preset.SpanID)
+	fill(&s.ParentSpanID, preset.ParentSpanID)
+	fill(&s.Service, preset.Service)
+	fill(&s.Operation, preset.Operation)
+	fill(&s.Start, preset.Start)
+	fill(&s.End, preset.End)
+	fill(&s.Duration, preset.Duration)
+	fill(&s.TimeUnit, preset.TimeUnit)
+	fill(&s.StatusCode, preset.StatusCode)
+	fill(&s.StatusMessage, preset.StatusMessage)
+	fill(&s.Host, preset.Host)
+	fill(&s.Resource, preset.Resource)
+	fill(&s.Attribute, preset.Attribute)
+	fill(&s.Logs, preset.Logs)
+	fill(&s.AttributeLayout, preset.AttributeLayout)
+	if _, ok := timeUnitNanos[s.TimeUnit]; !ok {
+		return s, fmt.Errorf("unknown trace time unit: %s", s.TimeUnit)
+	}
+	if s.Duration == "" && s.End == "" {
+		return s, fmt.Errorf("trace schema needs a duration or end column")
+	}
+	switch s.AttributeLayout {
+	case AttributeLayoutJSON, AttributeLayoutKVArray, AttributeLayoutPrefix:
+	default:
+		return s, fmt.Errorf("unknown trace attribute layout: %s", s.AttributeLayout)
+	}
+	return s, nil
+}
+
+// ToMillis converts a span time or duration in the schema unit to milliseconds.
+func (s *TraceSchema) ToMillis(v float64) float64 {
+	return v * timeUnitNanos[s.TimeUnit] / 1e6
+}
+
+// FromNanos converts nanoseconds to the schema unit.
+func (s *TraceSchema) FromNanos(v int64) int64 {
+	return int64(float64(v) / timeUnitNanos[s.TimeUnit])
+}
+
+// SpanDuration returns the duration of a span in the schema unit, computing it
+// from the end column when the schema has no duration column.
+func (s *TraceSchema) SpanDuration(alog map[string]string) (float64, error) {
+	if s.Duration != "" {
+		return strconv.ParseFloat(alog[s.Duration], 64)
+	}
+	start, err := strconv.ParseFloat(alog[s.Start], 64)
+	if err != nil {
+		return 0, err
+	}
+	end, err := strconv.ParseFloat(alog[s.End], 64)
+	if err != nil {
+		return 0, err
+	}
+	return end - start, nil
+}
+
+// DurationExpr is the SQL expression of the span duration in the schema unit.
+func (s *TraceSchema) DurationExpr() string {
+	if s.Duration != "" {
+		return quoteSQLIdent(s.Duration)
+	}
+	return "(" + quoteSQLIdent(s.End) + " - " + quoteSQLIdent(s.Start) + ")"
+}
+
+// ErrorExpr is the SQL condition matching failed spans, see normalizeStatusCode.
+// prefix qualifies the status column with a table alias such as "c.".
+func (s *TraceSchema) ErrorExpr(prefix string) string {
+	status := "upper(cast(" + prefix + quoteSQLIdent(s.StatusCode) + " as varchar))"
+	return "(" + status + " like '%ERROR%' or " + status + " in ('2', 'TRUE'))"
+}
+
+// Attributes returns the resource or attribute map of a span stored at column
+// according to the attribute layout, encoded as a JSON object.
+func (s *TraceSchema) Attributes(alog map[string]string, column string) string {
+	attrs := make(map[string]interface{})
+	switch s.AttributeLayout {
+	case AttributeLayoutPrefix:
+		for k, v := range alog {
+			if strings.HasPrefix(k, column) && k != column {
+				attrs[strings.TrimPrefix(k, column)] = v
+			}
+		}
+	case AttributeLayoutKVArray:
+		var kvs []map[string]interface{}
+		if err := json.Unmarshal([]byte(alog[column]), &kvs); err == nil {
+			for _, kv := range kvs {
+				if key, ok := kv["key"].(string); ok {
+					attrs[key] = kv["value"]
+				}
+			}
+		}
+	default:
+		if err := json.Unmarshal([]byte(alog[column]), &attrs); err != nil && alog[column] != "" {
+			attrs[column] = alog[column]
+		}
+	}
+	b, _ := json.Marshal(attrs)
+	return string(b)
+}
+
+// SpanLogs returns the span events as a JSON array of flat objects whose "time"
+// key is in nanoseconds, the shape the trace view in datasource.ts expects. A value
+// that is not a JSON array is kept as one event at the start of the span.
+func (s *TraceSchema) SpanLogs(alog map[string]string) string {
+	raw := strings.TrimSpace(alog[s.Logs])
+	if raw == "" {
+		return "[]"
+	}
+	var events []map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &events); err != nil {
+		event := map[string]interface{}{"message": raw}
+		if start, err := strconv.ParseFloat(alog[s.Start], 64); err == nil {
+			event["time"] = strconv.FormatFloat(start*timeUnitNanos[s.TimeUnit], 'f', 0, 64)
+		}
+		b, _ := json.Marshal([]map[string]interface{}{event})
+		return string(b)
+	}
+	for _, event := range events {
+		if fields, ok := event["fields"].([]interface{}); ok {
+			delete(event, "fields")
+			for _, f := range fields {
+				if kv, ok := f.(map[string]interface{}); ok {
+					if key, ok := kv["key"].(string); ok {
+						event[key] = kv["value"]
+					}
+				}
+			}
+		}
+		if _, ok := event["time"]; ok {
+			continue
+		}
+		for _, key := range []string{"timestamp", "time_unix_nano", "timeUnixNano"} {
+			if v, ok := event[key]; ok {
+				if t, err := strconv.ParseFloat(fmt.Sprint(v), 64); err == nil {
+					if key == "timestamp" {
+						t = t * timeUnitNanos[s.TimeUnit]
+					}
+					event["time"] = strconv.FormatFloat(t, 'f', 0, 64)
+				}
+				break
+			}
+		}
+	}
+	b, _ := json.Marshal(events)
+	return string(b)
+}
+
+// normalizeStatusCode maps OTel, Jaeger and Zipkin status values to the
+// OK/ERROR/UNSET values of the SLS Trace schema.
+func normalizeStatusCode(v string) string {
+	switch u := strings.ToUpper(v); {
+	case u == "" || u == "0" || u == "UNSET" || u == "STATUS_CODE_UNSET":
+		return "UNSET"
+	case u == "1" || u == "OK" || u == "STATUS_CODE_OK":
+		return "OK"
+	case u == "2" || u == "TRUE" || strings.Contains(u, "ERROR"):
+		return "ERROR"
+	default:
+		return v
+	}
+}
+
+// quoteSQLIdent quotes a column name so names with dots can be used in SQL.
+func quoteSQLIdent(v string) string {
+	return `"` + strings.ReplaceAll(v, `"`, `""`) + `"`
+}
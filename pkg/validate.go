@@ -0,0 +1,578 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+)
+
+const (
+	// SeverityError, SeverityWarning and SeverityInfo are the severities of a diagnostic.
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+	SeverityInfo    = "info"
+
+	// dryRunWindow is the time range of the dry run of a validated query.
+	dryRunWindow = time.Second
+	// dryRunInterval replaces the auto interval variables for the dry run.
+	dryRunInterval = time.Minute
+)
+
+// Diagnostic is a problem found in a query. Start and End are character offsets in the
+// query, Line and Column (1-based) locate Start.
+type Diagnostic struct {
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Start    int    `json:"start"`
+	End      int    `json:"end"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+}
+
+// ValidationResult lists the diagnostics of a query, it is valid without errors.
+type ValidationResult struct {
+	Valid       bool         `json:"valid"`
+	DryRun      bool         `json:"dryRun"`
+	Diagnostics []Diagnostic `json:"diagnostics"`
+}
+
+// token kinds of the query lexer.
+const (
+	tokenWord = iota
+	tokenQuoted
+	tokenString
+	tokenNumber
+	tokenVariable
+	tokenSymbol
+)
+
+// token is a lexeme of the query, start and end are byte offsets.
+type token struct {
+	kind  int
+	text  string
+	start int
+	end   int
+}
+
+// sqlKeywords are the words of an SQL query that do not name a column.
+var sqlKeywords = map[string]bool{}
+
+func init() {
+	for _, w := range strings.Fields(`select from where group by order having limit offset as and or not in is
+		null like between case when then else end asc desc distinct on join left right inner outer full cross
+		union all with over partition rows range preceding following unbounded current row true false cast
+		try_cast double bigint varchar integer int boolean timestamp date real decimal varbinary json interval
+		array map exists escape if any some nulls first last within filter second minute hour day week month
+		quarter year log using except intersect values lateral unnest ordinality`) {
+		sqlKeywords[w] = true
+	}
+}
+
+// timeSeriesPaddings are the padding modes of time_series.
+var timeSeriesPaddings = map[string]bool{"0": true, "null": true, "last": true, "next": true, "avg": true}
+
+// twoCharSymbols are the operators of two characters.
+var twoCharSymbols = map[string]bool{"<>": true, "<=": true, ">=": true, "!=": true, "->": true, "||": true}
+
+// dateTruncUnits are the units of date_trunc.
+var dateTruncUnits = map[string]bool{"second": true, "minute": true, "hour": true, "day": true,
+	"week": true, "month": true, "quarter": true, "year": true}
+
+var (
+	bucketIntervalRe = regexp.MustCompile(`^[1-9][0-9]*[smhd]$`)
+	slsErrorPosRe    = regexp.MustCompile(`line (\d+):(\d+)`)
+)
+
+// queryValidator collects the diagnostics of a query.
+type queryValidator struct {
+	query       string
+	diagnostics []Diagnostic
+}
+
+func (v *queryValidator) add(severity string, start int, end int, format string, args ...interface{}) {
+	if end < start {
+		end = start
+	}
+	line := strings.Count(v.query[:start], "\n") + 1
+	lineStart := strings.LastIndex(v.query[:start], "\n") + 1
+	v.diagnostics = append(v.diagnostics, Diagnostic{
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+		Start:    utf8.RuneCountInString(v.query[:start]),
+		End:      utf8.RuneCountInString(v.query[:end]),
+		Line:     line,
+		Column:   utf8.RuneCountInString(v.query[lineStart:start]) + 1,
+	})
+}
+
+// hasErrors reports whether diagnostics has an error.
+func hasErrors(diagnostics []Diagnostic) bool {
+	for _, d := range diagnostics {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateQuery checks query without running it: its syntax, the fields it references against
+// types (skipped when nil), the limit and the time buckets of its SQL. Diagnostics are sorted by position.
+func ValidateQuery(query string, types map[string]string, analytics map[string]bool) []Diagnostic {
+	v := &queryValidator{query: query}
+	search, sql, isSQL := splitPipe(query)
+	v.checkSearch(search, types)
+	if isSQL {
+		v.checkSQL(len(search)+1, sql, types, analytics)
+	}
+	sort.SliceStable(v.diagnostics, func(i, j int) bool { return v.diagnostics[i].Start < v.diagnostics[j].Start })
+	return v.diagnostics
+}
+
+// checkSearch checks the quotes, parentheses, operators and keys of the search part.
+func (v *queryValidator) checkSearch(search string, types map[string]string) {
+	tokens := v.lex(search, 0, false)
+	v.checkParens(tokens)
+	if len(tokens) > 0 {
+		last := tokens[len(tokens)-1]
+		switch strings.ToLower(last.text) {
+		case "and", "or", "not":
+			v.add(SeverityError, last.start, last.end, "%s is missing its right operand", last.text)
+		}
+	}
+	if types == nil {
+		return
+	}
+	for i := 0; i+1 < len(tokens); i++ {
+		t, next := tokens[i], tokens[i+1]
+		if t.kind != tokenWord && t.kind != tokenQuoted {
+			continue
+		}
+		if next.kind != tokenSymbol || !strings.Contains(":<>=", next.text[:1]) {
+			continue
+		}
+		name := unquoteIdentifier(t)
+		if isReservedField(name) {
+			continue
+		}
+		if _, ok := lookupField(types, name); !ok {
+			v.add(SeverityWarning, t.start, t.end, "field %s is not in the index of the logstore", name)
+		}
+	}
+}
+
+// checkSQL checks the SQL part, which starts at offset in the query.
+func (v *queryValidator) checkSQL(offset int, sql string, types map[string]string, analytics map[string]bool) {
+	tokens := v.lex(sql, offset, true)
+	if len(tokens) == 0 {
+		v.add(SeverityError, offset, offset, "the SQL after | is empty")
+		return
+	}
+	first := strings.ToLower(tokens[0].text)
+	if first != "select" && first != "with" {
+		v.add(SeverityError, tokens[0].start, tokens[0].end, "the SQL must start with SELECT, not %s", tokens[0].text)
+	}
+	for _, t := range tokens {
+		if t.kind == tokenSymbol && t.text == "|" {
+			v.add(SeverityError, t.start, t.end, "a query has at most one |")
+		}
+	}
+	v.checkParens(tokens)
+	v.checkLimit(offset, sql)
+	v.checkBuckets(tokens)
+	if types != nil {
+		v.checkColumns(tokens, types, analytics)
+	}
+}
+
+// checkParens reports unbalanced parentheses and brackets.
+func (v *queryValidator) checkParens(tokens []token) {
+	var open []token
+	closing := map[string]string{")": "(", "]": "["}
+	for _, t := range tokens {
+		if t.kind != tokenSymbol {
+			continue
+		}
+		switch t.text {
+		case "(", "[":
+			open = append(open, t)
+		case ")", "]":
+			if len(open) == 0 || open[len(open)-1].text != closing[t.text] {
+				v.add(SeverityError, t.start, t.end, "unexpected %s", t.text)
+				continue
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	for _, t := range open {
+		v.add(SeverityError, t.start, t.end, "%s is never closed", t.text)
+	}
+}
+
+// checkLimit warns when the outer select has no limit, SLS then returns 100 rows at most.
+func (v *queryValidator) checkLimit(offset int, sql string) {
+	found := false
+	scanKeywords(sql, func(pos int, word string, next string) bool {
+		if word == "limit" {
+			found = true
+			return false
+		}
+		return true
+	})
+	if !found {
+		end := offset + len(strings.TrimRight(sql, " \t\n;"))
+		v.add(SeverityWarning, end, end, "no LIMIT: SLS returns at most 100 rows")
+	}
+}
+
+// checkBuckets checks the time bucket expressions: __time__ - __time__ % n, time_series and date_trunc.
+func (v *queryValidator) checkBuckets(tokens []token) {
+	for i, t := range tokens {
+		switch {
+		case t.kind == tokenSymbol && t.text == "%" && i > 0 && strings.EqualFold(tokens[i-1].text, "__time__"):
+			if i+1 >= len(tokens) {
+				v.add(SeverityError, t.start, t.end, "the time bucket size is missing")
+				continue
+			}
+			n := tokens[i+1]
+			if n.kind == tokenVariable && n.text == autoIntervalSecondsVariable {
+				continue
+			}
+			if size, err := strconv.ParseInt(n.text, 10, 64); n.kind != tokenNumber || err != nil || size <= 0 {
+				v.add(SeverityError, n.start, n.end, "the time bucket size must be a positive number of seconds, not %s", n.text)
+			}
+		case t.kind == tokenWord && strings.EqualFold(t.text, "time_series") && i+1 < len(tokens) && tokens[i+1].text == "(":
+			v.checkTimeSeries(t, callArgs(tokens, i+1))
+		case t.kind == tokenWord && strings.EqualFold(t.text, "date_trunc") && i+1 < len(tokens) && tokens[i+1].text == "(":
+			args := callArgs(tokens, i+1)
+			if len(args) != 2 {
+				v.add(SeverityError, t.start, t.end, "date_trunc takes a unit and a time, got %d arguments", len(args))
+				continue
+			}
+			if unit := args[0]; len(unit) == 1 && unit[0].kind == tokenString && !dateTruncUnits[strings.ToLower(unquoteString(unit[0]))] {
+				v.add(SeverityError, unit[0].start, unit[0].end, "unknown date_trunc unit %s", unit[0].text)
+			}
+		}
+	}
+}
+
+// checkTimeSeries checks time_series(time, 'interval', 'format', 'padding').
+func (v *queryValidator) checkTimeSeries(fn token, args [][]token) {
+	if len(args) != 4 {
+		v.add(SeverityError, fn.start, fn.end, "time_series takes a time, an interval, a format and a padding, got %d arguments", len(args))
+		return
+	}
+	if interval := args[1]; len(interval) == 1 && interval[0].kind == tokenString {
+		s := unquoteString(interval[0])
+		if s != autoIntervalVariable && !bucketIntervalRe.MatchString(s) {
+			v.add(SeverityError, interval[0].start, interval[0].end, "invalid time_series interval %s, expected e.g. '1m', '5m' or '1h'", interval[0].text)
+		}
+	}
+	if padding := args[3]; len(padding) == 1 && padding[0].kind == tokenString && !timeSeriesPaddings[strings.ToLower(unquoteString(padding[0]))] {
+		v.add(SeverityError, padding[0].start, padding[0].end, "invalid time_series padding %s, expected '0', 'null', 'last', 'next' or 'avg'", padding[0].text)
+	}
+}
+
+// checkColumns warns about referenced columns missing from the index or not enabled for analytics.
+// Keywords, functions, aliases and the table name are skipped.
+func (v *queryValidator) checkColumns(tokens []token, types map[string]string, analytics map[string]bool) {
+	aliases := make(map[string]bool)
+	for i := 1; i < len(tokens); i++ {
+		if strings.EqualFold(tokens[i-1].text, "as") || isImplicitAlias(tokens, i) {
+			aliases[strings.ToLower(unquoteIdentifier(tokens[i]))] = true
+		}
+	}
+	for i, t := range tokens {
+		if t.kind != tokenWord && t.kind != tokenQuoted {
+			continue
+		}
+		name := unquoteIdentifier(t)
+		lower := strings.ToLower(name)
+		if t.kind == tokenWord && sqlKeywords[lower] {
+			continue
+		}
+		if i > 0 {
+			prev := strings.ToLower(tokens[i-1].text)
+			if prev == "as" || prev == "from" || prev == "join" || tokens[i-1].text == "." {
+				continue
+			}
+		}
+		if i+1 < len(tokens) && (tokens[i+1].text == "(" || tokens[i+1].text == "." || tokens[i+1].text == "->") {
+			continue
+		}
+		if aliases[lower] || isReservedField(name) {
+			continue
+		}
+		field, ok := lookupField(types, name)
+		if !ok {
+			v.add(SeverityWarning, t.start, t.end, "field %s is not in the index of the logstore", name)
+		} else if !analytics[field] {
+			v.add(SeverityWarning, t.start, t.end, "field %s is not enabled for analytics", name)
+		}
+	}
+}
+
+// isImplicitAlias reports whether tokens[i] is an alias without as, an identifier directly
+// following an expression like count(*) pv or status s.
+func isImplicitAlias(tokens []token, i int) bool {
+	t, prev := tokens[i], tokens[i-1]
+	if t.kind != tokenWord && t.kind != tokenQuoted || t.kind == tokenWord && sqlKeywords[strings.ToLower(t.text)] {
+		return false
+	}
+	if i+1 < len(tokens) && (tokens[i+1].text == "(" || tokens[i+1].text == "." || tokens[i+1].text == "->") {
+		return false
+	}
+	switch prev.kind {
+	case tokenQuoted, tokenString, tokenNumber:
+		return true
+	case tokenWord:
+		lower := strings.ToLower(prev.text)
+		return !sqlKeywords[lower] || lower == "end"
+	}
+	return prev.text == ")"
+}
+
+// callArgs returns the top level arguments of the call whose opening parenthesis is tokens[open].
+func callArgs(tokens []token, open int) [][]token {
+	var args [][]token
+	var current []token
+	depth := 0
+	for _, t := range tokens[open+1:] {
+		if t.kind == tokenSymbol {
+			switch t.text {
+			case "(", "[":
+				depth++
+			case ")", "]":
+				if depth == 0 {
+					if len(current) > 0 || len(args) > 0 {
+						args = append(args, current)
+					}
+					return args
+				}
+				depth--
+			case ",":
+				if depth == 0 {
+					args = append(args, current)
+					current = nil
+					continue
+				}
+			}
+		}
+		current = append(current, t)
+	}
+	return args
+}
+
+// lex splits s, found at offset in the query, into tokens and reports unterminated quotes.
+// Single quotes only delimit strings in SQL.
+func (v *queryValidator) lex(s string, offset int, sql bool) []token {
+	var tokens []token
+	isWordStart := func(c byte) bool { return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80 }
+	isWord := func(c byte) bool { return isWordStart(c) || c >= '0' && c <= '9' }
+	for i := 0; i < len(s); {
+		c := s[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case c == '"' || c == '\'' && sql:
+			i++
+			closed := false
+			for i < len(s) {
+				if s[i] == '\\' && c == '"' {
+					i += 2
+					continue
+				}
+				if s[i] == c {
+					if i+1 < len(s) && s[i+1] == c {
+						i += 2
+						continue
+					}
+					i++
+					closed = true
+					break
+				}
+				i++
+			}
+			if i > len(s) {
+				i = len(s)
+			}
+			if !closed {
+				v.add(SeverityError, offset+start, offset+len(s), "unterminated %c quote", c)
+			}
+			kind := tokenString
+			if c == '"' {
+				kind = tokenQuoted
+			}
+			tokens = append(tokens, token{kind: kind, text: s[start:i], start: offset + start, end: offset + i})
+			continue
+		case c >= '0' && c <= '9':
+			for i < len(s) && (s[i] >= '0' && s[i] <= '9' || s[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: s[start:i], start: offset + start, end: offset + i})
+			continue
+		case c == '$':
+			i++
+			for i < len(s) && isWord(s[i]) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenVariable, text: s[start:i], start: offset + start, end: offset + i})
+			continue
+		case isWordStart(c):
+			for i < len(s) && (isWord(s[i]) || s[i] == '.' && i+1 < len(s) && isWordStart(s[i+1])) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenWord, text: s[start:i], start: offset + start, end: offset + i})
+			continue
+		}
+		i++
+		if i < len(s) && twoCharSymbols[s[start:i+1]] {
+			i++
+		}
+		tokens = append(tokens, token{kind: tokenSymbol, text: s[start:i], start: offset + start, end: offset + i})
+	}
+	return tokens
+}
+
+// unquoteIdentifier returns the name of a word or a double quoted identifier.
+func unquoteIdentifier(t token) string {
+	if t.kind == tokenQuoted && len(t.text) >= 2 {
+		return strings.ReplaceAll(t.text[1:len(t.text)-1], `""`, `"`)
+	}
+	return t.text
+}
+
+// unquoteString returns the value of a single quoted string literal.
+func unquoteString(t token) string {
+	if len(t.text) >= 2 {
+		return strings.ReplaceAll(t.text[1:len(t.text)-1], "''", "'")
+	}
+	return t.text
+}
+
+// isReservedField reports whether name is a field SLS adds to every log.
+func isReservedField(name string) bool {
+	switch name {
+	case "__time__", "__topic__", "__source__", "__line__":
+		return true
+	}
+	return strings.HasPrefix(name, "__tag__")
+}
+
+// lookupField finds name among the indexed fields, ignoring case when there is no exact match.
+func lookupField(types map[string]string, name string) (string, bool) {
+	if _, ok := types[name]; ok {
+		return name, true
+	}
+	for k := range types {
+		if strings.EqualFold(k, name) {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// dryRunDiagnostic runs query on a tiny time window and turns an SLS error into a diagnostic,
+// positioned when the error gives a line and column in the SQL.
+func dryRunDiagnostic(client *sls.Client, project string, logstore string, query string) *Diagnostic {
+	to := time.Now().Unix()
+	run := expandIntervalVariables(query, dryRunInterval)
+	_, err := client.GetLogs(project, logstore, "", to-int64(dryRunWindow/time.Second), to, run, 1, 0, true)
+	if err == nil {
+		return nil
+	}
+	message := err.Error()
+	if e, ok := err.(*sls.Error); ok {
+		message = e.Code + ": " + e.Message
+	}
+	v := &queryValidator{query: query}
+	start, end := 0, len(query)
+	if m := slsErrorPosRe.FindStringSubmatch(message); m != nil {
+		if _, sql, isSQL := splitPipe(query); isSQL {
+			line, _ := strconv.Atoi(m[1])
+			col, _ := strconv.Atoi(m[2])
+			base := len(query) - len(sql) + (len(sql) - len(strings.TrimLeft(sql, " \t\n")))
+			if pos, ok := lineColumnOffset(query, base, line, col); ok {
+				start, end = pos, pos
+				for end < len(query) && query[end] != ' ' && query[end] != ',' && query[end] != ')' && query[end] != '\n' {
+					end++
+				}
+			}
+		}
+	}
+	v.add(SeverityError, start, end, "%s", message)
+	return &v.diagnostics[0]
+}
+
+// lineColumnOffset returns the byte offset of the 1-based line and column of the text starting at base.
+func lineColumnOffset(query string, base int, line int, col int) (int, bool) {
+	pos := base
+	for l := 1; l < line; l++ {
+		i := strings.IndexByte(query[pos:], '\n')
+		if i < 0 {
+			return 0, false
+		}
+		pos += i + 1
+	}
+	pos += col - 1
+	if pos < base || pos > len(query) {
+		return 0, false
+	}
+	return pos, true
+}
+
+// handleValidate validates a query and dry-runs it when it has no error.
+// Parameters: query, project, logstore and dryRun (true by default).
+func (ds *SlsDatasource) handleValidate(w http.ResponseWriter, r *http.Request) {
+	logSource, ok := resourceSettings(w, r)
+	if !ok {
+		return
+	}
+	project, logstore := resourceLogStore(logSource, r)
+	if !logSource.logStoreAllowed(project, logstore) {
+		writeResourceError(w, http.StatusForbidden, fmt.Errorf("logstore %s/%s is not allowed", project, logstore))
+		return
+	}
+	params := r.URL.Query()
+	query := params.Get("query")
+	if strings.TrimSpace(query) == "" {
+		query = "*"
+	}
+
+	var types map[string]string
+	var analytics map[string]bool
+	var diagnostics []Diagnostic
+	if idx, err := ds.GetIndex(logSource, project, logstore); err == nil && len(idx.Keys) > 0 {
+		types, analytics = idx.FieldTypes(), idx.analyticFields()
+	} else {
+		reason := "the logstore has no field index"
+		if err != nil {
+			reason = err.Error()
+		}
+		diagnostics = append(diagnostics, Diagnostic{Severity: SeverityInfo, Message: "fields not checked: " + reason, Line: 1, Column: 1})
+	}
+	diagnostics = append(diagnostics, ValidateQuery(query, types, analytics)...)
+
+	result := &ValidationResult{}
+	if !hasErrors(diagnostics) && params.Get("dryRun") != "false" {
+		if strings.Contains(expandIntervalVariables(query, dryRunInterval), "$") {
+			diagnostics = append(diagnostics, Diagnostic{Severity: SeverityInfo, Message: "not dry-run: the query has unresolved variables", Line: 1, Column: 1})
+		} else {
+			result.DryRun = true
+			if d := dryRunDiagnostic(NewClient(logSource), project, logstore, query); d != nil {
+				diagnostics = append(diagnostics, *d)
+			}
+		}
+	}
+	result.Valid = !hasErrors(diagnostics)
+	result.Diagnostics = append([]Diagnostic{}, diagnostics...)
+	writeJSON(w, result)
+}
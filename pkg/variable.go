@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	sls "github.com/aliyun/aliyun-log-go-sdk"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	// variableLines is the number of logs read by a variable search query, SQL queries use their own limit.
+	variableLines = 100
+
+	// VariableSortAlpha sorts variable values alphabetically, the default.
+	VariableSortAlpha = "alpha"
+	// VariableSortAlphaDesc sorts variable values alphabetically, descending.
+	VariableSortAlphaDesc = "alpha-desc"
+	// VariableSortNumeric sorts variable values as numbers, non numeric ones last.
+	VariableSortNumeric = "numeric"
+	// VariableSortNumericDesc sorts variable values as numbers, descending.
+	VariableSortNumericDesc = "numeric-desc"
+	// VariableSortNone keeps the values in query order.
+	VariableSortNone = "none"
+)
+
+// variableOption is one entry of a variable dropdown.
+type variableOption struct {
+	text  string
+	value string
+}
+
+// QueryVariable runs the query of a dashboard variable and builds its __text/__value frame.
+func (ds *SlsDatasource) QueryVariable(client *sls.Client, logSource *LogSource, queryInfo *QueryInfo,
+	from int64, to int64, frames *data.Frames) error {
+	var re *regexp.Regexp
+	if pattern := queryInfo.Regex; pattern != "" {
+		if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			pattern = pattern[1 : len(pattern)-1]
+		}
+		var err error
+		if re, err = regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid variable regex: %s", err.Error())
+		}
+	}
+	getLogsResp, err := client.GetLogs(logSource.Project, logSource.LogStore, "",
+		from, to, queryInfo.Query, variableLines, 0, true)
+	if err != nil {
+		log.DefaultLogger.Error("QueryVariable", "query", queryInfo.Query, "error", err)
+		return err
+	}
+	c := &Contents{}
+	if getLogsResp.Contents != "" {
+		_ = json.Unmarshal([]byte(getLogsResp.Contents), &c)
+	}
+	ds.BuildVariable(getLogsResp.Logs, c.Keys, queryInfo.TextField, queryInfo.ValueField, re, queryInfo.VariableSort, frames)
+	return nil
+}
+
+// BuildVariable builds the __text/__value frame of a variable. The value column defaults to the
+// first column and the text column to the value column. With a regex, only the texts matching it
+// are kept; named groups text and value, or else the first group, extract them. Values are
+// de-duplicated, keeping the first text, and sorted with sortMode.
+func (ds *SlsDatasource) BuildVariable(logs []map[string]string, keys []string, textCol string, valueCol string,
+	re *regexp.Regexp, sortMode string, frames *data.Frames) {
+	if valueCol == "" {
+		valueCol = firstColumn(logs, keys)
+	}
+	if textCol == "" {
+		textCol = valueCol
+	}
+	var options []variableOption
+	seen := make(map[string]bool)
+	for _, alog := range logs {
+		opt := variableOption{text: alog[textCol], value: alog[valueCol]}
+		if re != nil {
+			var ok bool
+			if opt, ok = applyVariableRegex(re, opt); !ok {
+				continue
+			}
+		}
+		if opt.text == "" {
+			opt.text = opt.value
+		}
+		if seen[opt.value] {
+			continue
+		}
+		seen[opt.value] = true
+		options = append(options, opt)
+	}
+	sortVariableOptions(options, sortMode)
+
+	texts := make([]string, 0, len(options))
+	values := make([]string, 0, len(options))
+	for _, opt := range options {
+		texts = append(texts, opt.text)
+		values = append(values, opt.value)
+	}
+	*frames = append(*frames, data.NewFrame("variable",
+		data.NewField("__text", nil, texts),
+		data.NewField("__value", nil, values)))
+}
+
+// firstColumn returns the first column of the result, skipping the SLS meta columns of logs.
+func firstColumn(logs []map[string]string, keys []string) string {
+	if len(keys) > 0 {
+		return keys[0]
+	}
+	if len(logs) == 0 {
+		return ""
+	}
+	var cols []string
+	for k := range logs[0] {
+		if !strings.HasPrefix(k, "__") {
+			cols = append(cols, k)
+		}
+	}
+	if len(cols) == 0 {
+		return ""
+	}
+	sort.Strings(cols)
+	return cols[0]
+}
+
+// applyVariableRegex matches re on the text of opt and extracts the text and value groups.
+func applyVariableRegex(re *regexp.Regexp, opt variableOption) (variableOption, bool) {
+	match := re.FindStringSubmatch(opt.text)
+	if match == nil {
+		return opt, false
+	}
+	named := false
+	for i, name := range re.SubexpNames() {
+		switch name {
+		case "text":
+			opt.text, named = match[i], true
+		case "value":
+			opt.value, named = match[i], true
+		}
+	}
+	if !named && len(match) > 1 {
+		opt.text, opt.value = match[1], match[1]
+	}
+	return opt, true
+}
+
+// sortVariableOptions sorts options by value with mode, VariableSortAlpha by default.
+func sortVariableOptions(options []variableOption, mode string) {
+	switch mode {
+	case VariableSortNone:
+		return
+	case VariableSortNumeric, VariableSortNumericDesc:
+		desc := mode == VariableSortNumericDesc
+		sort.SliceStable(options, func(i, j int) bool {
+			a, errA := strconv.ParseFloat(options[i].value, 64)
+			b, errB := strconv.ParseFloat(options[j].value, 64)
+			switch {
+			case errA != nil && errB != nil:
+				return options[i].value < options[j].value
+			case errA != nil || errB != nil:
+				return errB != nil
+			case desc:
+				return a > b
+			default:
+				return a < b
+			}
+		})
+	case VariableSortAlphaDesc:
+		sort.SliceStable(options, func(i, j int) bool { return options[i].value > options[j].value })
+	default:
+		sort.SliceStable(options, func(i, j int) bool { return options[i].value < options[j].value })
+	}
+}
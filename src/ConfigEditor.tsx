@@ -1,7 +1,7 @@
 import React, { ChangeEvent, PureComponent } from 'react';
-import { LegacyForms } from '@grafana/ui';
-import { DataSourcePluginOptionsEditorProps } from '@grafana/data';
-import { SLSDataSourceOptions, SLSSecureJsonData } from './types';
+import { Button, LegacyForms, InlineFormLabel, Select } from '@grafana/ui';
+import { DataSourcePluginOptionsEditorProps, SelectableValue } from '@grafana/data';
+import { DerivedField, SLSDataSourceOptions, SLSSecureJsonData, streamRoles, TraceSchema, traceSchemaPresets } from './types';
 
 const { SecretFormField, FormField } = LegacyForms;
 
@@ -34,6 +34,90 @@ export class SLSConfigEditor extends PureComponent<Props, State> {
     onOptionsChange({ ...options, jsonData });
   };
 
+  onTraceSchemaChange = (field: keyof TraceSchema) => (event: ChangeEvent<HTMLInputElement>) => {
+    const { onOptionsChange, options } = this.props;
+    const jsonData = {
+      ...options.jsonData,
+      traceSchema: { ...options.jsonData.traceSchema, [field]: event.target.value },
+    };
+    onOptionsChange({ ...options, jsonData });
+  };
+
+  onTracePresetChange = (value: SelectableValue<string>) => {
+    const { onOptionsChange, options } = this.props;
+    const jsonData = {
+      ...options.jsonData,
+      traceSchema: { ...options.jsonData.traceSchema, preset: value.value },
+    };
+    onOptionsChange({ ...options, jsonData });
+  };
+
+  onDerivedFieldsChange = (derivedFields: DerivedField[]) => {
+    const { onOptionsChange, options } = this.props;
+    onOptionsChange({ ...options, jsonData: { ...options.jsonData, derivedFields } });
+  };
+
+  onDerivedFieldChange = (index: number, key: keyof DerivedField) => (event: ChangeEvent<HTMLInputElement>) => {
+    const derivedFields = [...(this.props.options.jsonData.derivedFields || [])];
+    derivedFields[index] = { ...derivedFields[index], [key]: event.target.value };
+    this.onDerivedFieldsChange(derivedFields);
+  };
+
+  onAddDerivedField = () => {
+    this.onDerivedFieldsChange([...(this.props.options.jsonData.derivedFields || []), {}]);
+  };
+
+  onRemoveDerivedField = (index: number) => () => {
+    const derivedFields = [...(this.props.options.jsonData.derivedFields || [])];
+    derivedFields.splice(index, 1);
+    this.onDerivedFieldsChange(derivedFields);
+  };
+
+  onTimezoneChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const { onOptionsChange, options } = this.props;
+    const jsonData = {
+      ...options.jsonData,
+      timezone: event.target.value,
+    };
+    onOptionsChange({ ...options, jsonData });
+  };
+
+  onGeoIPDatabaseChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const { onOptionsChange, options } = this.props;
+    const jsonData = {
+      ...options.jsonData,
+      geoipDatabase: event.target.value,
+    };
+    onOptionsChange({ ...options, jsonData });
+  };
+
+  onMaxStreamsChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const { onOptionsChange, options } = this.props;
+    const jsonData = {
+      ...options.jsonData,
+      maxStreams: parseInt(event.target.value, 10) || undefined,
+    };
+    onOptionsChange({ ...options, jsonData });
+  };
+
+  onStreamRoleChange = (value: SelectableValue<string>) => {
+    const { onOptionsChange, options } = this.props;
+    const jsonData = {
+      ...options.jsonData,
+      streamRole: value.value,
+    };
+    onOptionsChange({ ...options, jsonData });
+  };
+
+  onAllowedLogStoresChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const { onOptionsChange, options } = this.props;
+    const jsonData = {
+      ...options.jsonData,
+      allowedLogStores: event.target.value,
+    };
+    onOptionsChange({ ...options, jsonData });
+  };
+
   // Secure field (only sent to the backend)
   onAKIDChange = (event: ChangeEvent<HTMLInputElement>) => {
     const { onOptionsChange, options } = this.props;
@@ -104,6 +188,25 @@ export class SLSConfigEditor extends PureComponent<Props, State> {
     const { options } = this.props;
     const { jsonData, secureJsonFields, url } = options;
     const secureJsonData = (options.secureJsonData || {}) as SLSSecureJsonData;
+    const traceSchema = jsonData.traceSchema || {};
+    const traceSchemaFields: Array<keyof TraceSchema> = [
+      'traceId',
+      'spanId',
+      'parentSpanId',
+      'service',
+      'operation',
+      'start',
+      'end',
+      'duration',
+      'timeUnit',
+      'statusCode',
+      'statusMessage',
+      'host',
+      'resource',
+      'attribute',
+      'logs',
+      'attributeLayout',
+    ];
 
     return (
       <div className="gf-form-group">
@@ -137,6 +240,60 @@ export class SLSConfigEditor extends PureComponent<Props, State> {
             placeholder="json field returned to frontend"
           />
         </div>
+        <div className="gf-form-inline">
+          <FormField
+            label="Timezone"
+            labelWidth={8}
+            inputWidth={25}
+            onChange={this.onTimezoneChange}
+            value={jsonData.timezone || ''}
+            placeholder="Asia/Shanghai, UTC, +08:00"
+          />
+        </div>
+        <div className="gf-form-inline">
+          <FormField
+            label="GeoIP DB"
+            labelWidth={8}
+            inputWidth={25}
+            onChange={this.onGeoIPDatabaseChange}
+            value={jsonData.geoipDatabase || ''}
+            placeholder="/var/lib/grafana/GeoLite2-City.mmdb"
+            tooltip="Local MaxMind database used to locate IP columns in geo queries"
+          />
+        </div>
+        <div className="gf-form-inline">
+          <FormField
+            label="Max streams"
+            labelWidth={8}
+            inputWidth={6}
+            onChange={this.onMaxStreamsChange}
+            value={jsonData.maxStreams || ''}
+            placeholder="10"
+            tooltip="Streaming queries running at the same time for this datasource"
+          />
+        </div>
+        <div className="gf-form-inline">
+          <InlineFormLabel width={8} tooltip="Lowest Grafana role allowed to subscribe to live tails and streaming panels">
+            Live role
+          </InlineFormLabel>
+          <Select
+            width={25}
+            options={streamRoles}
+            value={streamRoles.find((r) => r.value === (jsonData.streamRole || 'Viewer'))}
+            onChange={this.onStreamRoleChange}
+          />
+        </div>
+        <div className="gf-form-inline">
+          <FormField
+            label="Logstores"
+            labelWidth={8}
+            inputWidth={25}
+            onChange={this.onAllowedLogStoresChange}
+            value={jsonData.allowedLogStores || ''}
+            placeholder="project/logstore,project/*,*"
+            tooltip="Other logstores that queries and live streams may use, besides the datasource logstore"
+          />
+        </div>
         <div className="gf-form-inline">
           <div className="gf-form">
             <SecretFormField
@@ -165,6 +322,64 @@ export class SLSConfigEditor extends PureComponent<Props, State> {
             />
           </div>
         </div>
+        <h3 className="page-heading">Trace schema</h3>
+        <div className="gf-form-inline">
+          <InlineFormLabel width={8}>Preset</InlineFormLabel>
+          <Select
+            width={25}
+            options={traceSchemaPresets}
+            value={traceSchemaPresets.find((p) => p.value === (traceSchema.preset || 'sls'))}
+            onChange={this.onTracePresetChange}
+          />
+        </div>
+        {traceSchemaFields.map((field) => (
+          <div className="gf-form-inline" key={field}>
+            <FormField
+              label={field}
+              labelWidth={8}
+              inputWidth={25}
+              onChange={this.onTraceSchemaChange(field)}
+              value={traceSchema[field] || ''}
+              placeholder="preset default"
+            />
+          </div>
+        ))}
+        <h3 className="page-heading">Derived fields</h3>
+        {(jsonData.derivedFields || []).map((derivedField, index) => (
+          <div className="gf-form-inline" key={index}>
+            <FormField label="Name" labelWidth={5} inputWidth={8} value={derivedField.name || ''} onChange={this.onDerivedFieldChange(index, 'name')} />
+            <FormField
+              label="Regex"
+              labelWidth={5}
+              inputWidth={12}
+              value={derivedField.matcherRegex || ''}
+              onChange={this.onDerivedFieldChange(index, 'matcherRegex')}
+              placeholder={'traceId=(\\w+)'}
+            />
+            <FormField label="Field" labelWidth={5} inputWidth={8} value={derivedField.field || ''} onChange={this.onDerivedFieldChange(index, 'field')} placeholder="message" />
+            <FormField label="URL" labelWidth={4} inputWidth={12} value={derivedField.url || ''} onChange={this.onDerivedFieldChange(index, 'url')} />
+            <FormField
+              label="Datasource"
+              labelWidth={7}
+              inputWidth={8}
+              value={derivedField.datasourceName || ''}
+              onChange={this.onDerivedFieldChange(index, 'datasourceName')}
+              placeholder="this datasource"
+            />
+            <FormField
+              label="Query"
+              labelWidth={5}
+              inputWidth={16}
+              value={derivedField.query || ''}
+              onChange={this.onDerivedFieldChange(index, 'query')}
+              placeholder='{"type":"trace_id","traceId":"${__value.raw}"}'
+            />
+            <Button variant="secondary" icon="trash-alt" onClick={this.onRemoveDerivedField(index)} />
+          </div>
+        ))}
+        <Button variant="secondary" icon="plus" onClick={this.onAddDerivedField}>
+          Add
+        </Button>
       </div>
     );
   }
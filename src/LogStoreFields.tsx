@@ -0,0 +1,69 @@
+import React, { PureComponent } from 'react';
+import { AsyncSelect, InlineFormLabel } from '@grafana/ui';
+import { SelectableValue } from '@grafana/data';
+import { SLSDataSource } from './datasource';
+
+interface Props {
+  datasource: SLSDataSource;
+  project?: string;
+  logstore?: string;
+  onChange: (project?: string, logstore?: string) => void;
+}
+
+/**
+ * Project and logstore dropdowns, listed by the backend. Empty values use the datasource settings.
+ */
+export class LogStoreFields extends PureComponent<Props> {
+  loadProjects = (name: string): Promise<Array<SelectableValue<string>>> => {
+    return this.props.datasource.getProjects(name).then(toOptions);
+  };
+
+  loadLogStores = (name: string): Promise<Array<SelectableValue<string>>> => {
+    return this.props.datasource.getLogStores(this.props.project, name).then(toOptions);
+  };
+
+  onProjectChange = (value: SelectableValue<string> | null) => {
+    // the logstore belongs to the previous project
+    this.props.onChange(value?.value, undefined);
+  };
+
+  onLogStoreChange = (value: SelectableValue<string> | null) => {
+    this.props.onChange(this.props.project, value?.value);
+  };
+
+  render() {
+    const { datasource, project, logstore } = this.props;
+    const settings = datasource.instanceSettings.jsonData;
+
+    return (
+      <div className="gf-form-inline">
+        <InlineFormLabel width={6}>project</InlineFormLabel>
+        <AsyncSelect
+          key={'project'}
+          width={24}
+          isClearable
+          defaultOptions
+          loadOptions={this.loadProjects}
+          value={project ? { label: project, value: project } : null}
+          placeholder={settings.project || 'default'}
+          onChange={this.onProjectChange}
+        />
+        <InlineFormLabel width={6}>logstore</InlineFormLabel>
+        <AsyncSelect
+          key={project || 'logstore'}
+          width={24}
+          isClearable
+          defaultOptions
+          loadOptions={this.loadLogStores}
+          value={logstore ? { label: logstore, value: logstore } : null}
+          placeholder={settings.logstore || 'default'}
+          onChange={this.onLogStoreChange}
+        />
+      </div>
+    );
+  }
+}
+
+function toOptions(names: string[]): Array<SelectableValue<string>> {
+  return names.map((name) => ({ label: name, value: name }));
+}
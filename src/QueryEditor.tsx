@@ -1,21 +1,148 @@
 import { defaults } from 'lodash';
 
 import React, { ChangeEvent, PureComponent } from 'react';
-import { LegacyForms, InlineFormLabel } from '@grafana/ui';
-import { QueryEditorProps } from '@grafana/data';
+import { LegacyForms, InlineFormLabel, Select } from '@grafana/ui';
+import { QueryEditorProps, SelectableValue } from '@grafana/data';
 import { SLSDataSource } from './datasource';
-import { defaultQuery, SLSDataSourceOptions, SLSQuery } from './types';
+import { LogStoreFields } from './LogStoreFields';
+import {
+  compareModes,
+  defaultQuery,
+  downsampleModes,
+  nullModes,
+  QueryDiagnostic,
+  queryTypes,
+  SLSDataSourceOptions,
+  SLSQuery,
+} from './types';
 
 const { FormField } = LegacyForms;
 
 type Props = QueryEditorProps<SLSDataSource, SLSQuery, SLSDataSourceOptions>;
 
-export class SLSQueryEditor extends PureComponent<Props> {
+interface State {
+  fields: Array<SelectableValue<string>>;
+  diagnostics: QueryDiagnostic[];
+}
+
+export class SLSQueryEditor extends PureComponent<Props, State> {
+  state: State = { fields: [], diagnostics: [] };
+
+  componentDidMount() {
+    this.loadFields();
+  }
+
+  componentDidUpdate(prevProps: Props) {
+    const { project, logstore } = this.props.query;
+    if (project !== prevProps.query.project || logstore !== prevProps.query.logstore) {
+      this.loadFields();
+    }
+  }
+
+  // loads the indexed fields of the logstore for completion
+  loadFields() {
+    const { datasource, query } = this.props;
+    datasource
+      .getIndexFields(query.project, query.logstore)
+      .then((fields) => this.setState({ fields: fields.map((f) => ({ label: f.name, value: f.name, description: f.type })) }))
+      .catch(() => this.setState({ fields: [] }));
+  }
+
+  // validates the query, the diagnostics are listed under the query input
+  validate(text?: string) {
+    const { datasource, query } = this.props;
+    if (!text) {
+      this.setState({ diagnostics: [] });
+      return;
+    }
+    datasource
+      .validateQuery(text, query.project, query.logstore)
+      .then((res) => this.setState({ diagnostics: res.diagnostics || [] }))
+      .catch(() => this.setState({ diagnostics: [] }));
+  }
+
+  onQueryBlur = (event: ChangeEvent<HTMLInputElement>) => {
+    this.onQueryTextChange(event);
+    this.validate(event.target.value);
+  };
+
+  onFieldInsert = (value: SelectableValue<string>) => {
+    const { onChange, query } = this.props;
+    const text = query.query || '';
+    onChange({ ...query, query: text + (text === '' || text.endsWith(' ') ? '' : ' ') + value.value });
+  };
+
   onQueryTextChange = (event: ChangeEvent<HTMLInputElement>) => {
     const { onChange, query } = this.props;
     onChange({ ...query, query: event.target.value });
   };
 
+  onTypeChange = (value: SelectableValue<string>) => {
+    const { onChange, query, onRunQuery } = this.props;
+    onChange({ ...query, type: value.value });
+    // executes the query
+    onRunQuery();
+  };
+
+  onLogStoreChange = (project?: string, logstore?: string) => {
+    const { onChange, query, onRunQuery } = this.props;
+    onChange({ ...query, project, logstore });
+    // executes the query
+    onRunQuery();
+  };
+
+  onNullModeChange = (value: SelectableValue<string>) => {
+    const { onChange, query, onRunQuery } = this.props;
+    onChange({ ...query, nullMode: value.value });
+    // executes the query
+    onRunQuery();
+  };
+
+  onDownsampleChange = (value: SelectableValue<string>) => {
+    const { onChange, query, onRunQuery } = this.props;
+    onChange({ ...query, downsample: value.value });
+    // executes the query
+    onRunQuery();
+  };
+
+  onCompareChange = (value: SelectableValue<string>) => {
+    const { onChange, query, onRunQuery } = this.props;
+    onChange({ ...query, compare: value.value });
+    // executes the query
+    onRunQuery();
+  };
+
+  onStreamChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const { onChange, query, onRunQuery } = this.props;
+    onChange({ ...query, stream: event.target.checked || undefined });
+    // executes the query
+    onRunQuery();
+  };
+
+  onTopNChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const { onChange, query } = this.props;
+    onChange({ ...query, topN: parseInt(event.target.value, 10) || undefined });
+  };
+
+  onPieFormatChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const { onChange, query, onRunQuery } = this.props;
+    onChange({ ...query, pieFormat: event.target.checked ? 'long' : undefined });
+    // executes the query
+    onRunQuery();
+  };
+
+  onBarModeChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const { onChange, query, onRunQuery } = this.props;
+    onChange({ ...query, barMode: event.target.checked ? 'series' : undefined });
+    // executes the query
+    onRunQuery();
+  };
+
+  onFieldChange = (field: keyof SLSQuery) => (event: ChangeEvent<HTMLInputElement>) => {
+    const { onChange, query } = this.props;
+    onChange({ ...query, [field]: event.target.value });
+  };
+
   onXChange = (event: ChangeEvent<HTMLInputElement>) => {
     const { onChange, query, onRunQuery } = this.props;
     onChange({ ...query, xcol: event.target.value });
@@ -30,10 +157,46 @@ export class SLSQueryEditor extends PureComponent<Props> {
     onRunQuery();
   };
 
-  render() {
-    const dq = defaults(this.props.query, defaultQuery);
-    const { query, xcol, ycol } = dq;
+  renderTraceFields() {
+    const { type, traceId, service, operation, minDuration, maxDuration, status } = this.props.query;
+    if (type === 'trace_id') {
+      return (
+        <div className="gf-form-inline">
+          <FormField
+            labelWidth={6}
+            inputWidth={30}
+            value={traceId || ''}
+            onChange={this.onFieldChange('traceId')}
+            onBlur={this.props.onRunQuery}
+            label="traceId"
+          />
+        </div>
+      );
+    }
+    return (
+      <div className="gf-form-inline">
+        <FormField labelWidth={6} inputWidth={12} value={service || ''} onChange={this.onFieldChange('service')} label="service" />
+        <FormField labelWidth={6} inputWidth={12} value={operation || ''} onChange={this.onFieldChange('operation')} label="operation" />
+        <FormField labelWidth={6} inputWidth={6} value={minDuration || ''} onChange={this.onFieldChange('minDuration')} label="min" />
+        <FormField labelWidth={6} inputWidth={6} value={maxDuration || ''} onChange={this.onFieldChange('maxDuration')} label="max" />
+        <FormField labelWidth={6} inputWidth={6} value={status || ''} onChange={this.onFieldChange('status')} label="status" />
+      </div>
+    );
+  }
 
+  renderRedMetricsFields() {
+    const { service, operation, step } = this.props.query;
+    return (
+      <div className="gf-form-inline">
+        <FormField labelWidth={6} inputWidth={12} value={service || ''} onChange={this.onFieldChange('service')} label="service" />
+        <FormField labelWidth={6} inputWidth={12} value={operation || ''} onChange={this.onFieldChange('operation')} label="operation" />
+        <FormField labelWidth={6} inputWidth={6} value={step || ''} onChange={this.onFieldChange('step')} label="step" placeholder="auto" />
+      </div>
+    );
+  }
+
+  renderQueryInput(query?: string) {
+    const { fields, diagnostics } = this.state;
     return (
       <>
         <div className="gf-form-inline">
@@ -44,13 +207,204 @@ export class SLSQueryEditor extends PureComponent<Props> {
             className="gf-form-input"
             value={query}
             onChange={this.onQueryTextChange}
-            onBlur={this.onQueryTextChange}
+            onBlur={this.onQueryBlur}
           ></input>
+          {fields.length > 0 && (
+            <Select width={20} placeholder="insert field" options={fields} value={null} onChange={this.onFieldInsert} />
+          )}
+        </div>
+        {diagnostics.map((d, i) => (
+          <div key={i} className="gf-form-inline">
+            <InlineFormLabel width={6} className={d.severity === 'error' ? 'text-error' : d.severity === 'warning' ? 'text-warning' : ''}>
+              {d.severity}
+            </InlineFormLabel>
+            <span className="gf-form-label">
+              {d.line}:{d.column} {d.message}
+              {d.end > d.start ? ` (${(query || '').substring(d.start, d.end)})` : ''}
+            </span>
+          </div>
+        ))}
+      </>
+    );
+  }
+
+  renderGeoFields() {
+    const dq = defaults(this.props.query, defaultQuery);
+    const { query, latitude, longitude, geohash, country, province, ip } = dq;
+    return (
+      <>
+        {this.renderQueryInput(query)}
+        <div className="gf-form-inline">
+          <FormField labelWidth={6} inputWidth={8} value={latitude || ''} onChange={this.onFieldChange('latitude')} label="latitude" placeholder="auto" />
+          <FormField labelWidth={6} inputWidth={8} value={longitude || ''} onChange={this.onFieldChange('longitude')} label="longitude" placeholder="auto" />
+          <FormField labelWidth={6} inputWidth={8} value={geohash || ''} onChange={this.onFieldChange('geohash')} label="geohash" placeholder="auto" />
+        </div>
+        <div className="gf-form-inline">
+          <FormField labelWidth={6} inputWidth={8} value={country || ''} onChange={this.onFieldChange('country')} label="country" placeholder="auto" />
+          <FormField labelWidth={6} inputWidth={8} value={province || ''} onChange={this.onFieldChange('province')} label="province" placeholder="auto" />
+          <FormField labelWidth={6} inputWidth={8} value={ip || ''} onChange={this.onFieldChange('ip')} label="ip" placeholder="auto" />
         </div>
+      </>
+    );
+  }
+
+  renderQueryFields() {
+    const dq = defaults(this.props.query, defaultQuery);
+    const { type, query, xcol, ycol, timeFormat, nullMode, topN, pieFormat, legend, barMode, buckets, downsample, chunk, timeShifts, compare, stream, streamInterval } = dq;
+    return (
+      <>
+        {this.renderQueryInput(query)}
         <div className="gf-form-inline">
           <FormField labelWidth={6} inputWidth={30} value={ycol} onChange={this.onYChange} label="ycol" />
           <FormField labelWidth={6} inputWidth={20} value={xcol} onChange={this.onXChange} label="xcol(time)" />
+          <FormField
+            labelWidth={6}
+            inputWidth={12}
+            value={timeFormat || ''}
+            onChange={this.onFieldChange('timeFormat')}
+            label="timeFormat"
+            placeholder="auto"
+          />
+          <InlineFormLabel width={6}>nulls</InlineFormLabel>
+          <Select
+            width={12}
+            options={nullModes}
+            value={nullModes.find((m) => m.value === (nullMode || 'null'))}
+            onChange={this.onNullModeChange}
+          />
+          <InlineFormLabel width={8} tooltip="Aggregation used when the result has more points than the panel can show">
+            downsample
+          </InlineFormLabel>
+          <Select
+            width={10}
+            options={downsampleModes}
+            value={downsampleModes.find((m) => m.value === (downsample || 'avg'))}
+            onChange={this.onDownsampleChange}
+          />
+          <FormField
+            labelWidth={6}
+            inputWidth={6}
+            value={chunk || ''}
+            onChange={this.onFieldChange('chunk')}
+            label="chunk"
+            placeholder="off"
+            tooltip="Split long time ranges into windows such as 1d or 6h, or auto"
+          />
+        </div>
+        {xcol !== 'bar' && ycol && ycol.indexOf('#:#') !== -1 && (
+          <div className="gf-form-inline">
+            <FormField
+              labelWidth={6}
+              inputWidth={30}
+              value={legend || ''}
+              onChange={this.onFieldChange('legend')}
+              label="legend"
+              placeholder="{{label}} {{__field__}}"
+            />
+          </div>
+        )}
+        <div className="gf-form-inline">
+          <FormField
+            labelWidth={6}
+            inputWidth={12}
+            value={timeShifts || ''}
+            onChange={this.onFieldChange('timeShifts')}
+            label="shifts"
+            placeholder="1d,7d"
+            tooltip="Add the series of earlier periods, moved to the current time range"
+          />
+          <InlineFormLabel width={6}>compare</InlineFormLabel>
+          <Select
+            width={14}
+            options={compareModes}
+            value={compareModes.find((m) => m.value === (compare || ''))}
+            onChange={this.onCompareChange}
+          />
+        </div>
+        {query && query.indexOf('|') !== -1 && (
+          <div className="gf-form-inline">
+            <InlineFormLabel width={6} tooltip="Rerun the query over the panel time range sliding to now and update the panel in place">
+              stream
+            </InlineFormLabel>
+            <input type="checkbox" checked={!!stream} onChange={this.onStreamChange} />
+            {stream && (
+              <FormField
+                labelWidth={6}
+                inputWidth={6}
+                value={streamInterval || ''}
+                onChange={this.onFieldChange('streamInterval')}
+                label="every"
+                placeholder="5s"
+              />
+            )}
+          </div>
+        )}
+        {type === 'histogram' && (
+          <div className="gf-form-inline">
+            <FormField
+              labelWidth={6}
+              inputWidth={30}
+              value={buckets || ''}
+              onChange={this.onFieldChange('buckets')}
+              label="buckets"
+              placeholder="auto, or bounds like 0,100,500,1000"
+            />
+          </div>
+        )}
+        {xcol === 'bar' && (
+          <div className="gf-form-inline">
+            <InlineFormLabel width={12} tooltip="Use the first category as the axis and the others as series">
+              split series
+            </InlineFormLabel>
+            <input type="checkbox" checked={barMode === 'series'} onChange={this.onBarModeChange} />
+          </div>
+        )}
+        {xcol === 'pie' && (
+          <div className="gf-form-inline">
+            <FormField labelWidth={6} inputWidth={6} value={topN || ''} onChange={this.onTopNChange} label="topN" placeholder="all" />
+            <InlineFormLabel width={6}>long format</InlineFormLabel>
+            <input type="checkbox" checked={pieFormat === 'long'} onChange={this.onPieFormatChange} />
+          </div>
+        )}
+      </>
+    );
+  }
+
+  renderFields(type?: string) {
+    switch (type) {
+      case 'trace_id':
+      case 'trace_search':
+        return this.renderTraceFields();
+      case 'service_graph':
+        return null;
+      case 'red_metrics':
+        return this.renderRedMetricsFields();
+      case 'geo':
+        return this.renderGeoFields();
+      default:
+        return this.renderQueryFields();
+    }
+  }
+
+  render() {
+    const { datasource, query } = this.props;
+    const { type, project, logstore } = query;
+
+    return (
+      <>
+        <div className="gf-form-inline">
+          <InlineFormLabel width={6} className="query-keyword">
+            Type
+          </InlineFormLabel>
+          <Select
+            width={20}
+            options={queryTypes}
+            value={queryTypes.find((t) => t.value === (type || '')) || queryTypes[0]}
+            onChange={this.onTypeChange}
+          />
         </div>
+        <LogStoreFields datasource={datasource} project={project} logstore={logstore} onChange={this.onLogStoreChange} />
+        {this.renderFields(type)}
       </>
     );
   }
@@ -1,9 +1,10 @@
 import React, { ChangeEvent, PureComponent } from 'react';
-import { SLSDataSourceOptions, SLSQuery } from './types';
+import { SLSDataSourceOptions, SLSQuery, variableSorts } from './types';
 
-import { LegacyForms } from '@grafana/ui';
-import { QueryEditorProps } from '@grafana/data';
+import { InlineFormLabel, LegacyForms, Select } from '@grafana/ui';
+import { QueryEditorProps, SelectableValue } from '@grafana/data';
 import { SLSDataSource } from './datasource';
+import { LogStoreFields } from './LogStoreFields';
 const { FormField } = LegacyForms;
 
 type Props = QueryEditorProps<SLSDataSource, SLSQuery, SLSDataSourceOptions>;
@@ -14,14 +15,67 @@ export class SLSVariableQueryEditor extends PureComponent<Props> {
     onChange({ ...query, query: event.target.value });
   };
 
+  onFieldChange = (field: keyof SLSQuery) => (event: ChangeEvent<HTMLInputElement>) => {
+    const { onChange, query } = this.props;
+    onChange({ ...query, [field]: event.target.value || undefined });
+  };
+
+  onSortChange = (value: SelectableValue<string>) => {
+    const { onChange, query } = this.props;
+    onChange({ ...query, sort: value.value });
+  };
+
+  onLogStoreChange = (project?: string, logstore?: string) => {
+    const { onChange, query } = this.props;
+    onChange({ ...query, project, logstore });
+  };
+
   render() {
-    const { query } = this.props.query;
+    const { datasource } = this.props;
+    const { query, project, logstore, textField, valueField, regex, sort } = this.props.query;
 
     return (
       <>
+        <LogStoreFields datasource={datasource} project={project} logstore={logstore} onChange={this.onLogStoreChange} />
         <div className="gf-form-inline">
           <FormField labelWidth={6} inputWidth={30} value={query} onChange={this.onQueryTextChange} label="query" />
         </div>
+        <div className="gf-form-inline">
+          <FormField
+            labelWidth={6}
+            inputWidth={12}
+            value={valueField || ''}
+            onChange={this.onFieldChange('valueField')}
+            label="value"
+            placeholder="first column"
+          />
+          <FormField
+            labelWidth={6}
+            inputWidth={12}
+            value={textField || ''}
+            onChange={this.onFieldChange('textField')}
+            label="text"
+            placeholder="value column"
+          />
+        </div>
+        <div className="gf-form-inline">
+          <FormField
+            labelWidth={6}
+            inputWidth={20}
+            value={regex || ''}
+            onChange={this.onFieldChange('regex')}
+            label="regex"
+            placeholder="/(?P<text>.*)-(?P<value>.*)/"
+            tooltip="Keep the texts matching the regex; named groups text and value, or the first group, extract them"
+          />
+          <InlineFormLabel width={6}>sort</InlineFormLabel>
+          <Select
+            width={20}
+            options={variableSorts}
+            value={variableSorts.find((s) => s.value === (sort || 'alpha'))}
+            onChange={this.onSortChange}
+          />
+        </div>
       </>
     );
   }
@@ -8,9 +8,10 @@ import {
   DataSourceInstanceSettings,
   FieldType,
   MutableDataFrame,
+  TimeRange,
   Vector,
 } from '@grafana/data';
-import { SLSDataSourceOptions, SLSQuery } from './types';
+import { IndexField, LogStoreIndex, QueryValidation, SLSDataSourceOptions, SLSQuery } from './types';
 import { DataSourceWithBackend, getBackendSrv, getTemplateSrv } from '@grafana/runtime';
 import _ from 'lodash';
 import { map } from 'rxjs/operators';
@@ -23,31 +24,107 @@ export class SLSDataSource extends DataSourceWithBackend<SLSQuery, SLSDataSource
   query(options: DataQueryRequest<SLSQuery>) {
     options.targets.forEach((q: SLSQuery) => {
       q.query = replaceQueryParameters(q, options);
+      // Explore Live mode: the backend answers with a channel tailing the logstore
+      q.mode = options.liveStreaming ? 'live' : undefined;
+      // dashboard ad-hoc filters, applied by the backend to every query
+      const adhocFilters = (getTemplateSrv() as any).getAdhocFilters?.(this.name) || [];
+      q.adhocFilters = adhocFilters.length > 0 ? adhocFilters : undefined;
     });
-    if (options.targets[0].xcol === 'trace') {
+    if (options.targets[0].xcol === 'trace' || options.targets[0].type === 'trace_id') {
       return super.query(options).pipe(map(responseToDataQueryResponse));
     }
     return super.query(options);
   }
 
+  getProjects(name?: string): Promise<string[]> {
+    return this.getResource('projects', { name: name || '' }).then((res) => res.items || []);
+  }
+
+  getLogStores(project?: string, name?: string): Promise<string[]> {
+    return this.getResource('logstores', { project: project || '', name: name || '' }).then((res) => res.items || []);
+  }
+
+  getIndex(project?: string, logstore?: string): Promise<LogStoreIndex> {
+    return this.getResource('index', { project: project || '', logstore: logstore || '' });
+  }
+
+  // returns the indexed keys and JSON sub-keys of the logstore
+  getIndexFields(project?: string, logstore?: string): Promise<IndexField[]> {
+    return this.getIndex(project, logstore).then((index) =>
+      _.flatMap(index.keys || [], (key) => [key, ...(key.jsonKeys || [])])
+    );
+  }
+
+  getTagKeys() {
+    return this.getResource('tag-keys');
+  }
+
+  getTagValues(options: any = {}) {
+    const range = options.timeRange || options.range;
+    return this.getResource('tag-values', {
+      key: options.key,
+      from: range ? range.from.valueOf().toString() : '',
+      to: range ? range.to.valueOf().toString() : '',
+    });
+  }
+
+  // returns the top values of a field over the logs of a search, with min/max/avg and
+  // percentiles for numeric fields
+  getFieldDistribution(field: string, query: string, range: TimeRange, topN = 10, project?: string, logstore?: string) {
+    return this.getResource('distribution', {
+      field,
+      query,
+      topN,
+      from: range.from.valueOf().toString(),
+      to: range.to.valueOf().toString(),
+      project: project || '',
+      logstore: logstore || '',
+    });
+  }
+
+  // checks a query against the syntax and the index of the logstore, then runs it on a tiny
+  // time window unless dryRun is false
+  validateQuery(query: string, project?: string, logstore?: string, dryRun = true): Promise<QueryValidation> {
+    return this.getResource('validate', {
+      query,
+      project: project || '',
+      logstore: logstore || '',
+      dryRun: dryRun.toString(),
+    });
+  }
+
+  // runs a variable query, the backend answers with a __text/__value frame. Variables used
+  // in the query or the regex are replaced, so a variable can depend on another one.
   metricFindQuery(query: SLSQuery|string, options?: any) {
+    const q: SLSQuery = typeof query === 'string' ? ({ query } as SLSQuery) : query;
     const data = {
       from: options.range.from.valueOf().toString(),
       to: options.range.to.valueOf().toString(),
       queries: [
         {
+          refId: 'A',
           datasource: this.name,
           datasourceId: this.id,
-          query: replaceQueryParameters(query, options),
+          type: 'variable',
+          query: replaceQueryParameters(q, options),
+          project: q.project,
+          logstore: q.logstore,
+          textField: q.textField,
+          valueField: q.valueField,
+          regex: q.regex ? getTemplateSrv().replace(q.regex, options.scopedVars, 'regex') : undefined,
+          sort: q.sort,
         },
       ],
     };
     return getBackendSrv()
       .post('/api/ds/query', data)
       .then((response) => {
-        return response.results.A.frames[0].data.values;
-      })
-      .then(mapToTextValue);
+        const result = response.results.A;
+        if (result.error) {
+          throw new Error(result.error);
+        }
+        return frameToTextValue(result.frames && result.frames[0]);
+      });
   }
 }
 
@@ -148,20 +225,13 @@ function responseToDataQueryResponse(response: DataQueryResponse): DataQueryResp
   };
 }
 
-export function mapToTextValue(result: any) {
-  if (Array.isArray(result) && result.length === 2) {
-    return _.map(result[0], (d, i) => {
-      return { text: d, value: result[1][i] };
-    });
+// frameToTextValue reads the __text/__value frame of a variable query
+export function frameToTextValue(frame: any) {
+  if (!frame || !frame.data || frame.data.values.length < 2) {
+    return [];
   }
-  return _.map(result[0], (d, i) => {
-    if (d && d.text && d.value) {
-      return { text: d.text, value: d.value };
-    } else if (_.isObject(d)) {
-      return { text: d, value: i };
-    }
-    return { text: d, value: d };
-  });
+  const [texts, values] = frame.data.values;
+  return _.map(values, (value: string, i: number) => ({ text: texts[i], value }));
 }
 
 export function replaceQueryParameters(q: SLSQuery|string, options: DataQueryRequest<SLSQuery>) {
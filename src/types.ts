@@ -6,8 +6,54 @@ export interface SLSQuery extends DataQuery {
   ycol?: string;
   logsPerPage?: number;
   currentPage?: number;
+  type?: string;
+  mode?: string;
+  project?: string;
+  logstore?: string;
+  textField?: string;
+  valueField?: string;
+  regex?: string;
+  sort?: string;
+  adhocFilters?: Array<{ key: string; operator: string; value: string }>;
+  traceId?: string;
+  service?: string;
+  operation?: string;
+  minDuration?: string;
+  maxDuration?: string;
+  status?: string;
+  step?: string;
+  timeFormat?: string;
+  nullMode?: string;
+  topN?: number;
+  pieFormat?: string;
+  legend?: string;
+  barMode?: string;
+  buckets?: string;
+  downsample?: string;
+  chunk?: string;
+  timeShifts?: string;
+  compare?: string;
+  stream?: boolean;
+  streamInterval?: string;
+  latitude?: string;
+  longitude?: string;
+  geohash?: string;
+  country?: string;
+  province?: string;
+  ip?: string;
 }
 
+export const queryTypes = [
+  { label: 'Default', value: '' },
+  { label: 'Trace ID', value: 'trace_id' },
+  { label: 'Trace search', value: 'trace_search' },
+  { label: 'Service graph', value: 'service_graph' },
+  { label: 'RED metrics', value: 'red_metrics' },
+  { label: 'Geo', value: 'geo' },
+  { label: 'Heatmap', value: 'heatmap' },
+  { label: 'Histogram', value: 'histogram' },
+];
+
 export const defaultQuery: Partial<SLSQuery> = {
   query: '* | select count(*) as c, __time__-__time__%60 as t group by t',
   xcol: 't',
@@ -16,6 +62,80 @@ export const defaultQuery: Partial<SLSQuery> = {
   currentPage: 1,
 };
 
+export const nullModes = [
+  { label: 'Null', value: 'null' },
+  { label: 'Zero', value: 'zero' },
+  { label: 'Drop row', value: 'drop' },
+];
+
+export const downsampleModes = [
+  { label: 'Avg', value: 'avg' },
+  { label: 'Max', value: 'max' },
+  { label: 'Min', value: 'min' },
+  { label: 'Sum', value: 'sum' },
+  { label: 'Last', value: 'last' },
+];
+
+export const compareModes = [
+  { label: 'None', value: '' },
+  { label: 'Ratio', value: 'ratio' },
+  { label: 'Difference', value: 'diff' },
+];
+
+export const variableSorts = [
+  { label: 'Alphabetical', value: 'alpha' },
+  { label: 'Alphabetical (desc)', value: 'alpha-desc' },
+  { label: 'Numerical', value: 'numeric' },
+  { label: 'Numerical (desc)', value: 'numeric-desc' },
+  { label: 'Query order', value: 'none' },
+];
+
+export const streamRoles = [
+  { label: 'Viewer', value: 'Viewer' },
+  { label: 'Editor', value: 'Editor' },
+  { label: 'Admin', value: 'Admin' },
+];
+
+/**
+ * Index configuration of a logstore, returned by the index resource
+ */
+export interface IndexField {
+  name: string;
+  type: string;
+  alias?: string;
+  analytics: boolean;
+  jsonKeys?: IndexField[];
+}
+
+export interface LogStoreIndex {
+  fullText?: {
+    caseSensitive: boolean;
+    chinese: boolean;
+    tokens: string[];
+    includeKeys?: string[];
+    excludeKeys?: string[];
+  };
+  keys: IndexField[];
+}
+
+/**
+ * Problem found in a query by the validate resource, start and end are character offsets in the query
+ */
+export interface QueryDiagnostic {
+  severity: 'error' | 'warning' | 'info';
+  message: string;
+  start: number;
+  end: number;
+  line: number;
+  column: number;
+}
+
+export interface QueryValidation {
+  valid: boolean;
+  dryRun: boolean;
+  diagnostics: QueryDiagnostic[];
+}
+
 /**
  * These are options configured for each DataSource instance
  */
@@ -23,8 +143,57 @@ export interface SLSDataSourceOptions extends DataSourceJsonData {
   endpoint?: string;
   project?: string;
   logstore?: string;
+  timezone?: string;
+  traceSchema?: TraceSchema;
+  derivedFields?: DerivedField[];
+  geoipDatabase?: string;
+  maxStreams?: number;
+  streamRole?: string;
+  allowedLogStores?: string;
 }
 
+/**
+ * Extracts a value from log lines and links it to a URL or to a datasource query
+ */
+export interface DerivedField {
+  name?: string;
+  matcherRegex?: string;
+  field?: string;
+  url?: string;
+  datasourceName?: string;
+  query?: string;
+}
+
+/**
+ * Maps trace logstore columns, empty fields fall back to the preset
+ */
+export interface TraceSchema {
+  preset?: string;
+  traceId?: string;
+  spanId?: string;
+  parentSpanId?: string;
+  service?: string;
+  operation?: string;
+  start?: string;
+  end?: string;
+  duration?: string;
+  timeUnit?: string;
+  statusCode?: string;
+  statusMessage?: string;
+  host?: string;
+  resource?: string;
+  attribute?: string;
+  logs?: string;
+  attributeLayout?: string;
+}
+
+export const traceSchemaPresets = [
+  { label: 'SLS Trace', value: 'sls' },
+  { label: 'OpenTelemetry', value: 'otel' },
+  { label: 'Jaeger', value: 'jaeger' },
+  { label: 'Zipkin', value: 'zipkin' },
+];
+
 /**
  * Value that is used in the backend, but never sent over HTTP to the frontend
  */